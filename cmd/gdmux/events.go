@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+
+	"github.com/LHSRobotics/gdmux/pkg/dmux"
+)
+
+// The event types gdmux adds to the executor's.
+const (
+	// eventLog carries a line of the log, in Text.
+	eventLog = "log"
+	// eventGap tells a client it's missed some events, which were too long ago to replay.
+	eventGap = "gap"
+)
+
+// replaySize is how many events are kept for clients that connect, or fall behind, mid-job.
+const replaySize = 5000
+
+// event is an event as it's sent to clients, numbered so they can tell if they've missed any.
+type event struct {
+	Seq  uint64
+	Time time.Time
+	dmux.Event
+}
+
+// eventHub numbers the events and keeps the latest of them, waking up the clients as they come
+// in. Clients read the events from the hub at their own pace, rather than having them pushed, so a
+// slow client catches up instead of losing events, as long as it's no more than replaySize behind.
+type eventHub struct {
+	sync.Mutex
+	// buf holds at least the last replaySize events, in order.
+	buf  []event
+	next uint64
+	subs map[chan bool]bool
+}
+
+var events = &eventHub{next: 1, subs: make(map[chan bool]bool)}
+
+// publish adds an event, without blocking.
+func (h *eventHub) publish(ev dmux.Event) {
+	h.Lock()
+	defer h.Unlock()
+	h.buf = append(h.buf, event{Seq: h.next, Time: time.Now(), Event: ev})
+	h.next++
+	// Trim the buffer every so often rather than every time, to save on copying.
+	if len(h.buf) >= 2*replaySize {
+		h.buf = append([]event(nil), h.buf[len(h.buf)-replaySize:]...)
+	}
+	for c := range h.subs {
+		select {
+		case c <- true:
+		default:
+		}
+	}
+}
+
+// since returns the events after seq that are still kept, and reports whether any after it have
+// been forgotten.
+func (h *eventHub) since(seq uint64) (evs []event, lost bool) {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.buf) == 0 {
+		return nil, false
+	}
+	first := h.buf[0].Seq
+	if seq+1 < first {
+		return append(evs, h.buf...), true
+	}
+	return append(evs, h.buf[seq+1-first:]...), false
+}
+
+// subscribe returns a channel that gets a value whenever there are new events, until it's passed
+// to unsubscribe.
+func (h *eventHub) subscribe() chan bool {
+	c := make(chan bool, 1)
+	h.Lock()
+	h.subs[c] = true
+	h.Unlock()
+	return c
+}
+
+func (h *eventHub) unsubscribe(c chan bool) {
+	h.Lock()
+	delete(h.subs, c)
+	h.Unlock()
+}
+
+func weblog(msg string) {
+	log.Printf("%s", msg)
+	events.publish(dmux.Event{Type: eventLog, Text: msg})
+}
+
+// handleLog sends the events to a websocket client as JSON, one to a message, starting with the
+// ones that are kept, or with those after the "since" sequence number, for a client reconnecting.
+func handleLog(ws *websocket.Conn) {
+	c := events.subscribe()
+	defer events.unsubscribe(c)
+
+	var last uint64
+	resuming := false
+	if s := ws.Request().FormValue("since"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return
+		}
+		last, resuming = n, true
+	}
+
+	enc := json.NewEncoder(ws)
+	for {
+		evs, lost := events.since(last)
+		// A new client gets whatever's kept, without being told it's missed the rest.
+		if lost && resuming {
+			gap := event{Time: time.Now(), Event: dmux.Event{
+				Type: eventGap,
+				Text: fmt.Sprintf("missed events %d to %d", last+1, evs[0].Seq-1),
+			}}
+			if err := enc.Encode(gap); err != nil {
+				return
+			}
+		}
+		for _, ev := range evs {
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			last = ev.Seq
+		}
+		resuming = true
+		<-c
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/LHSRobotics/gdmux/pkg/dmux"
+)
+
+func TestEventReplay(t *testing.T) {
+	h := &eventHub{next: 1, subs: make(map[chan bool]bool)}
+	if evs, lost := h.since(0); len(evs) != 0 || lost {
+		t.Errorf("empty hub gives %d events, lost %v", len(evs), lost)
+	}
+
+	// Enough events that the first ones are forgotten.
+	n := uint64(2*replaySize + 10)
+	for i := uint64(0); i < n; i++ {
+		h.publish(dmux.Event{Type: eventLog})
+	}
+	first := h.buf[0].Seq
+	if n-first+1 < replaySize {
+		t.Fatalf("only events %d to %d are kept", first, n)
+	}
+	for _, tc := range []struct {
+		since, size uint64
+		lost        bool
+	}{
+		{since: 0, size: n - first + 1, lost: true},
+		{since: first - 2, size: n - first + 1, lost: true},
+		{since: first - 1, size: n - first + 1, lost: false},
+		{since: n - 3, size: 3, lost: false},
+		{since: n, size: 0, lost: false},
+	} {
+		evs, lost := h.since(tc.since)
+		if uint64(len(evs)) != tc.size || lost != tc.lost {
+			t.Errorf("since(%d) gives %d events, lost %v, want %d, lost %v", tc.since, len(evs), lost, tc.size, tc.lost)
+			continue
+		}
+		if len(evs) > 0 && (evs[0].Seq != n-tc.size+1 || evs[len(evs)-1].Seq != n) {
+			t.Errorf("since(%d) gives events %d to %d, want %d to %d", tc.since, evs[0].Seq, evs[len(evs)-1].Seq, n-tc.size+1, n)
+		}
+	}
+}
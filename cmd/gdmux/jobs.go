@@ -0,0 +1,752 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LHSRobotics/gdmux/pkg/dmux"
+)
+
+// The states a job goes through. Jobs start out queued, and end up done, failed if the program
+// gave an error, cancelled if they were taken off the queue or stopped while running, or
+// interrupted if gdmux went away while they were running.
+const (
+	jobQueued      = "queued"
+	jobRunning     = "running"
+	jobDone        = "done"
+	jobFailed      = "failed"
+	jobCancelled   = "cancelled"
+	jobInterrupted = "interrupted"
+)
+
+// JobOptions change how a job is run.
+type JobOptions struct {
+	// Plan says the source is a motion plan, as /plan gives them, rather than G-code.
+	Plan bool `json:",omitempty"`
+	// WCS is the work coordinate system to select before running the job, such as "G55".
+	WCS string `json:",omitempty"`
+	// OptionalStop turns optional stops (M1) on or off before running the job.
+	OptionalStop *bool `json:",omitempty"`
+	// From is the line to resume the program from, as dmux.Executor.RunFrom does.
+	From int `json:",omitempty"`
+}
+
+// Job is a program waiting to be run, being run or that's been run.
+type Job struct {
+	ID   int
+	Name string
+	// File is the library program the source was read from, if any. The job keeps its own
+	// copy, so later changes to the file don't affect it.
+	File string `json:",omitempty"`
+	// Source is the program, on its way into the queue. The queue keeps it in a file of its own,
+	// so the queue file stays small; jobQueue.source reads it back.
+	Source    string `json:"-"`
+	Submitter string
+	Options   JobOptions
+	Status    string
+	Error     string `json:",omitempty"`
+	// Checkpoint is the line the program had got to, saved every so often as it runs. It's
+	// where a job that failed, was stopped or was interrupted can be resumed from.
+	Checkpoint int `json:",omitempty"`
+
+	Submitted time.Time
+	Started   time.Time
+	Finished  time.Time
+}
+
+// checkpointEvery is how often the running job's checkpoint is saved.
+const checkpointEvery = time.Second
+
+// jobQueue holds the submitted jobs, in the order they're run, and runs them one at a time. Every
+// change is saved to path, if it's set, so the queue survives a restart, and the jobs' sources go
+// in a directory next to it. Without a path, the sources stay in the jobs.
+type jobQueue struct {
+	sync.Mutex
+	path   string
+	jobs   []*Job
+	nextID int
+	// held stops the queue from starting on any more jobs until it's released.
+	held bool
+	// cur is the job being run, if any.
+	cur *Job
+	// wakec tells run there may be something new to do.
+	wakec chan bool
+}
+
+var jobs *jobQueue
+
+// loadJobs reads the job queue from path. Jobs that were running when gdmux went away are marked
+// as interrupted rather than run again, since the arm may have been halfway through them. If there
+// are jobs left over, the queue is held, so the arm doesn't start moving as soon as gdmux starts.
+func loadJobs(path string) (*jobQueue, error) {
+	q := &jobQueue{path: path, nextID: 1, wakec: make(chan bool, 1)}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &q.jobs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for _, j := range q.jobs {
+		if j.ID >= q.nextID {
+			q.nextID = j.ID + 1
+		}
+		switch j.Status {
+		case jobRunning:
+			j.Status = jobInterrupted
+		case jobQueued:
+			q.held = true
+		}
+	}
+	return q, q.save()
+}
+
+// save writes the queue to disk. The caller must hold the lock.
+func (q *jobQueue) save() error {
+	if q.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(q.jobs, "", "\t")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a crash doesn't leave us with half a queue.
+	tmp := q.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// sourceDir is the directory the jobs' sources are kept in, named after the queue file.
+func (q *jobQueue) sourceDir() string {
+	return strings.TrimSuffix(q.path, filepath.Ext(q.path)) + ".d"
+}
+
+func (q *jobQueue) sourcePath(id int) string {
+	return filepath.Join(q.sourceDir(), strconv.Itoa(id))
+}
+
+// source returns the job's program.
+func (q *jobQueue) source(j *Job) (string, error) {
+	if q.path == "" {
+		return j.Source, nil
+	}
+	b, err := ioutil.ReadFile(q.sourcePath(j.ID))
+	return string(b), err
+}
+
+// saveLogged saves the queue, logging rather than returning any error, for when the job has
+// already been dealt with and there's nobody to tell. The caller must hold the lock.
+func (q *jobQueue) saveLogged() {
+	if err := q.save(); err != nil {
+		weblog(fmt.Sprintf("Error saving the job queue: %s\n", err))
+	}
+}
+
+func (q *jobQueue) wake() {
+	select {
+	case q.wakec <- true:
+	default:
+	}
+}
+
+// Add puts a job at the end of the queue. If the queue can't be saved, the job isn't added.
+func (q *jobQueue) Add(j *Job) error {
+	// The source can be long, so it's written to a file of its own without holding up the queue,
+	// and given the job's name once it has an ID.
+	tmp, err := q.writeSource(j.Source)
+	if err != nil {
+		return err
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	j.ID = q.nextID
+	q.nextID++
+	if q.path != "" {
+		if err := os.Rename(tmp, q.sourcePath(j.ID)); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		j.Source = ""
+	}
+	j.Status = jobQueued
+	j.Submitted = time.Now()
+	q.jobs = append(q.jobs, j)
+	if err := q.save(); err != nil {
+		q.jobs = q.jobs[:len(q.jobs)-1]
+		if q.path != "" {
+			os.Remove(q.sourcePath(j.ID))
+		}
+		return err
+	}
+	q.wake()
+	return nil
+}
+
+// writeSource writes a new job's source to a temporary file in the source directory, and returns
+// its path. Without a path, the source stays in the job, and there's nothing to write.
+func (q *jobQueue) writeSource(src string) (string, error) {
+	if q.path == "" {
+		return "", nil
+	}
+	if err := os.MkdirAll(q.sourceDir(), 0755); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(q.sourceDir(), "new-")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// List returns a copy of the jobs, in order.
+func (q *jobQueue) List() []Job {
+	q.Lock()
+	defer q.Unlock()
+	l := make([]Job, len(q.jobs))
+	for i, j := range q.jobs {
+		l[i] = *j
+	}
+	return l
+}
+
+// find returns the index of the job with the given id, or -1. The caller must hold the lock.
+func (q *jobQueue) find(id int) int {
+	for i, j := range q.jobs {
+		if j.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Move moves a queued job so it's run after pos other queued jobs. Position 0 is the next job to
+// run.
+func (q *jobQueue) Move(id, pos int) error {
+	q.Lock()
+	defer q.Unlock()
+	i := q.find(id)
+	if i < 0 {
+		return fmt.Errorf("no job %d", id)
+	}
+	j := q.jobs[i]
+	if j.Status != jobQueued {
+		return fmt.Errorf("job %d is %s, not queued", id, j.Status)
+	}
+	q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+
+	// Insert the job before the queued job that's at pos now, or at the end if there isn't one.
+	at := len(q.jobs)
+	for k, o := range q.jobs {
+		if o.Status != jobQueued {
+			continue
+		}
+		if pos <= 0 {
+			at = k
+			break
+		}
+		pos--
+	}
+	q.jobs = append(q.jobs, nil)
+	copy(q.jobs[at+1:], q.jobs[at:])
+	q.jobs[at] = j
+	return q.save()
+}
+
+// Cancel takes a queued job off the queue, or stops it if it's running.
+func (q *jobQueue) Cancel(id int) error {
+	q.Lock()
+	defer q.Unlock()
+	i := q.find(id)
+	if i < 0 {
+		return fmt.Errorf("no job %d", id)
+	}
+	j := q.jobs[i]
+	switch {
+	case j.Status == jobQueued:
+		j.Status = jobCancelled
+		j.Finished = time.Now()
+		return q.save()
+	case j == q.cur:
+		// run marks it as cancelled once the executor has stopped.
+		j.Status = jobCancelled
+		executor.Stop()
+		return nil
+	}
+	return fmt.Errorf("job %d is %s already", id, j.Status)
+}
+
+// cancelCurrent marks the running job, if there is one, as cancelled, for when the program is
+// being stopped.
+func (q *jobQueue) cancelCurrent() {
+	q.Lock()
+	if q.cur != nil {
+		q.cur.Status = jobCancelled
+	}
+	q.Unlock()
+}
+
+// Clear forgets about the jobs that are finished with, and their sources.
+func (q *jobQueue) Clear() error {
+	q.Lock()
+	defer q.Unlock()
+	var left []*Job
+	for _, j := range q.jobs {
+		if j.Status == jobQueued || j == q.cur {
+			left = append(left, j)
+		} else if q.path != "" {
+			os.Remove(q.sourcePath(j.ID))
+		}
+	}
+	q.jobs = left
+	return q.save()
+}
+
+// Hold stops the queue from starting on any more jobs, or lets it carry on.
+func (q *jobQueue) Hold(on bool) {
+	q.Lock()
+	q.held = on
+	q.Unlock()
+	q.wake()
+}
+
+// status returns the job being run, if any, how many are queued, and whether the queue is held.
+func (q *jobQueue) status() (cur *jobSummary, queued int, held bool) {
+	q.Lock()
+	defer q.Unlock()
+	if q.cur != nil {
+		s := summarize(*q.cur)
+		cur = &s
+	}
+	for _, j := range q.jobs {
+		if j.Status == jobQueued {
+			queued++
+		}
+	}
+	return cur, queued, q.held
+}
+
+// Held reports whether the queue is held.
+func (q *jobQueue) Held() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.held
+}
+
+// next marks the first queued job as running and returns it, or returns nil if there's nothing to
+// run yet.
+func (q *jobQueue) next() *Job {
+	q.Lock()
+	defer q.Unlock()
+	if q.held {
+		return nil
+	}
+	for _, j := range q.jobs {
+		if j.Status == jobQueued {
+			j.Status = jobRunning
+			j.Started = time.Now()
+			q.cur = j
+			q.saveLogged()
+			return j
+		}
+	}
+	return nil
+}
+
+// checkpoints saves the line the running job has got to every checkpointEvery, for ever. It runs
+// on a goroutine of its own, so saving doesn't hold up the program.
+func (q *jobQueue) checkpoints() {
+	for range time.Tick(checkpointEvery) {
+		q.checkpoint()
+	}
+}
+
+// checkpoint saves the line the running job has got to, if it's changed. Until a resumed job gets
+// to the line it's resumed from, it stays at that line.
+func (q *jobQueue) checkpoint() {
+	p := executor.Progress()
+	q.Lock()
+	defer q.Unlock()
+	// Before the job starts and after it ends, the progress is some other run's.
+	if q.cur == nil || !p.Running {
+		return
+	}
+	if p.Line < q.cur.Options.From || p.Line == q.cur.Checkpoint {
+		return
+	}
+	q.cur.Checkpoint = p.Line
+	q.saveLogged()
+}
+
+// finish records how the running job went. If it was stopped or failed, the queue is held, so the
+// arm doesn't carry on with the next job before someone's had a look.
+func (q *jobQueue) finish(j *Job, err error) {
+	q.Lock()
+	defer q.Unlock()
+	q.cur = nil
+	// A resumed job that didn't get as far as its first line can be resumed from there again.
+	j.Checkpoint = executor.Progress().Line
+	if j.Checkpoint < j.Options.From {
+		j.Checkpoint = j.Options.From
+	}
+	j.Finished = time.Now()
+	switch {
+	case j.Status == jobCancelled:
+		q.held = true
+	case err != nil:
+		j.Status = jobFailed
+		j.Error = err.Error()
+		q.held = true
+	default:
+		j.Status = jobDone
+	}
+	q.saveLogged()
+}
+
+// run runs the queued jobs, one at a time, for ever.
+func (q *jobQueue) run() {
+	for {
+		j := q.next()
+		if j == nil {
+			<-q.wakec
+			continue
+		}
+		weblog(fmt.Sprintf("Running job %d (%s) from %s\n", j.ID, j.Name, j.Submitter))
+		sessionLock.Lock()
+		err := runJob(j)
+		sessionLock.Unlock()
+		if err != nil {
+			weblog(fmt.Sprintf("%s\n", err))
+		}
+		q.finish(j, err)
+		weblog(fmt.Sprintf("Job %d %s.\n", j.ID, j.Status))
+		if q.Held() {
+			weblog("The queue is held until it's released.\n")
+		}
+	}
+}
+
+// runJob applies the job's options and runs it on the executor.
+func runJob(j *Job) error {
+	src, err := jobs.source(j)
+	if err != nil {
+		return err
+	}
+	if j.Options.WCS != "" {
+		i, err := dmux.WCSIndex(j.Options.WCS)
+		if err != nil {
+			return err
+		}
+		if err := wcs.Select(i); err != nil {
+			return err
+		}
+	}
+	if j.Options.OptionalStop != nil {
+		executor.SetOptionalStop(*j.Options.OptionalStop)
+	}
+
+	if j.Options.Plan {
+		p, err := dmux.ReadPlan(strings.NewReader(src))
+		if err != nil {
+			return err
+		}
+		return executor.RunPlanFrom(p, j.Options.From)
+	}
+	return executor.RunFrom(strings.NewReader(src), j.Options.From)
+}
+
+// jobFromRequest makes a job out of a request posting a program. The body is the source, unless
+// the "file" URL parameter names a program in the library, and the "name", "submitter", "wcs",
+// "optionalstop" and "from" URL parameters fill in the rest.
+func jobFromRequest(r *http.Request, plan bool) (*Job, error) {
+	// Read the parameters from the URL alone, since the body is the program.
+	v := r.URL.Query()
+	j := &Job{
+		Name:      v.Get("name"),
+		File:      v.Get("file"),
+		Submitter: v.Get("submitter"),
+		Options:   JobOptions{Plan: plan, WCS: v.Get("wcs")},
+	}
+
+	var src []byte
+	var err error
+	if j.File != "" {
+		src, err = programs.Read(j.File)
+	} else {
+		src, err = ioutil.ReadAll(r.Body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	j.Source = string(src)
+
+	switch {
+	case j.Name != "":
+	case j.File != "":
+		j.Name = j.File
+	default:
+		j.Name = "untitled"
+	}
+	if j.Submitter == "" {
+		j.Submitter = r.RemoteAddr
+	}
+	if j.Options.WCS != "" {
+		if _, err := dmux.WCSIndex(j.Options.WCS); err != nil {
+			return nil, err
+		}
+	}
+	if s := v.Get("optionalstop"); s != "" {
+		on, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, errors.New("optionalstop must be true or false")
+		}
+		j.Options.OptionalStop = &on
+	}
+	if s := v.Get("from"); s != "" {
+		if j.Options.From, err = strconv.Atoi(s); err != nil {
+			return nil, fmt.Errorf("bad line number: %s", s)
+		}
+	}
+	return j, nil
+}
+
+// submitJob queues the program posted to /run or /runplan, and sends back the job as /jobs
+// reports it.
+func submitJob(w http.ResponseWriter, r *http.Request, plan bool) {
+	j, err := jobFromRequest(r, plan)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if plan {
+		if _, err := dmux.ReadPlan(strings.NewReader(j.Source)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := jobs.Add(j); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	weblog(fmt.Sprintf("Queued job %d (%s) from %s\n", j.ID, j.Name, j.Submitter))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summarize(*j))
+}
+
+// jobSummary is how /jobs reports a job.
+type jobSummary struct {
+	ID         int
+	Name       string
+	File       string `json:",omitempty"`
+	Submitter  string
+	Options    JobOptions
+	Status     string
+	Error      string `json:",omitempty"`
+	Checkpoint int    `json:",omitempty"`
+	Submitted  time.Time
+	Started    time.Time
+	Finished   time.Time
+}
+
+func summarize(j Job) jobSummary {
+	return jobSummary{
+		ID:         j.ID,
+		Name:       j.Name,
+		File:       j.File,
+		Submitter:  j.Submitter,
+		Options:    j.Options,
+		Status:     j.Status,
+		Error:      j.Error,
+		Checkpoint: j.Checkpoint,
+		Submitted:  j.Submitted,
+		Started:    j.Started,
+		Finished:   j.Finished,
+	}
+}
+
+// queueStatus is what /jobs reports.
+type queueStatus struct {
+	Held bool
+	Jobs []jobSummary
+}
+
+// handleJobs reports the jobs as JSON, in the order they're run.
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	st := queueStatus{Held: jobs.Held(), Jobs: []jobSummary{}}
+	for _, j := range jobs.List() {
+		st.Jobs = append(st.Jobs, summarize(j))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// jobID reads the "id" form value.
+func jobID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		return 0, fmt.Errorf("bad job id: %s", r.FormValue("id"))
+	}
+	return id, nil
+}
+
+// handleJobMove moves the job given by the "id" form value to position "pos" among the queued
+// jobs, where 0 is next.
+func handleJobMove(w http.ResponseWriter, r *http.Request) {
+	id, err := jobID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pos, err := strconv.Atoi(r.FormValue("pos"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad position: %s", r.FormValue("pos")), http.StatusBadRequest)
+		return
+	}
+	if err := jobs.Move(id, pos); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	weblog(fmt.Sprintf("Got request from %s to move job %d to position %d\n", r.RemoteAddr, id, pos))
+}
+
+// handleJobCancel cancels the job given by the "id" form value.
+func handleJobCancel(w http.ResponseWriter, r *http.Request) {
+	id, err := jobID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := jobs.Cancel(id); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	weblog(fmt.Sprintf("Got request from %s to cancel job %d\n", r.RemoteAddr, id))
+}
+
+// Resume queues a copy of a job that's finished with, to run from the given line, or from its
+// checkpoint if line is 0.
+func (q *jobQueue) Resume(id, line int, submitter string) (*Job, error) {
+	q.Lock()
+	i := q.find(id)
+	if i < 0 {
+		q.Unlock()
+		return nil, fmt.Errorf("no job %d", id)
+	}
+	old := *q.jobs[i]
+	q.Unlock()
+
+	switch old.Status {
+	case jobQueued, jobRunning:
+		return nil, fmt.Errorf("job %d is %s", id, old.Status)
+	}
+	if line == 0 {
+		line = old.Checkpoint
+	}
+	if line < 1 {
+		return nil, fmt.Errorf("job %d has no line to resume from", id)
+	}
+	src, err := q.source(&old)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Job{
+		Name:      fmt.Sprintf("%s from line %d", old.Name, line),
+		File:      old.File,
+		Source:    src,
+		Submitter: submitter,
+		Options:   old.Options,
+	}
+	j.Options.From = line
+	return j, q.Add(j)
+}
+
+// handleJobResume queues the job given by the "id" form value again, to carry on from the line
+// given by "line", or from where it got to.
+func handleJobResume(w http.ResponseWriter, r *http.Request) {
+	id, err := jobID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	line := 0
+	if s := r.FormValue("line"); s != "" {
+		if line, err = strconv.Atoi(s); err != nil {
+			http.Error(w, fmt.Sprintf("bad line number: %s", s), http.StatusBadRequest)
+			return
+		}
+	}
+	j, err := jobs.Resume(id, line, r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	weblog(fmt.Sprintf("Queued job %d (%s) from %s\n", j.ID, j.Name, j.Submitter))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summarize(*j))
+}
+
+// handleJobClear forgets about the finished jobs.
+func handleJobClear(w http.ResponseWriter, r *http.Request) {
+	if err := jobs.Clear(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	weblog(fmt.Sprintf("Got request from %s to clear the finished jobs\n", r.RemoteAddr))
+}
+
+// handleJobHold holds the queue or lets it carry on, going by the "on" form value.
+func handleJobHold(w http.ResponseWriter, r *http.Request) {
+	on, err := strconv.ParseBool(r.FormValue("on"))
+	if err != nil {
+		http.Error(w, "on must be true or false", http.StatusBadRequest)
+		return
+	}
+	jobs.Hold(on)
+	if on {
+		weblog(fmt.Sprintf("Got request from %s to hold the job queue\n", r.RemoteAddr))
+	} else {
+		weblog(fmt.Sprintf("Got request from %s to start the job queue\n", r.RemoteAddr))
+	}
+}
+
+// initJobs loads the job queue and starts running it.
+func initJobs() {
+	var err error
+	jobs, err = loadJobs(*queueFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jobs.Held() {
+		log.Println("There are jobs left in the queue from last time; POST /jobs/hold?on=false to run them")
+	}
+	go jobs.run()
+	go jobs.checkpoints()
+}
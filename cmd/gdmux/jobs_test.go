@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/LHSRobotics/gdmux/pkg/dmux"
+	"github.com/LHSRobotics/gdmux/pkg/staubli"
+)
+
+// testQueue returns an empty job queue saved in a temporary directory, with the executor running
+// the jobs on rec. It's made the queue jobs run from, as initJobs would.
+func testQueue(t *testing.T, rec *staubli.Recorder) (*jobQueue, func()) {
+	dir, err := ioutil.TempDir("", "gdmux-jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := loadJobs(filepath.Join(dir, "queue.json"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	executor = dmux.New(rec, dmux.Options{Log: func(string) {}})
+	jobs = q
+	return q, func() { os.RemoveAll(dir) }
+}
+
+// add queues a job with the given name and source.
+func add(t *testing.T, q *jobQueue, name, src string) *Job {
+	j := &Job{Name: name, Source: src, Submitter: "test"}
+	if err := q.Add(j); err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+// queued returns the IDs of the queued jobs, in the order they'll run.
+func queued(q *jobQueue) []int {
+	var ids []int
+	for _, j := range q.List() {
+		if j.Status == jobQueued {
+			ids = append(ids, j.ID)
+		}
+	}
+	return ids
+}
+
+func sameIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestQueueSaved(t *testing.T) {
+	q, cleanup := testQueue(t, &staubli.Recorder{})
+	defer cleanup()
+	add(t, q, "one", "G1 X1 Y0 Z0\n")
+	add(t, q, "two", "G1 X2 Y0 Z0\n")
+	add(t, q, "three", "G1 X3 Y0 Z0\n")
+	if j := q.next(); j == nil || j.ID != 1 {
+		t.Fatalf("next job is %v, want job 1", j)
+	}
+
+	// Loading it again is what happens when gdmux restarts with job 1 running.
+	r, err := loadJobs(q.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name, status, src string
+	}{
+		{"one", jobInterrupted, "G1 X1 Y0 Z0\n"},
+		{"two", jobQueued, "G1 X2 Y0 Z0\n"},
+		{"three", jobQueued, "G1 X3 Y0 Z0\n"},
+	}
+	l := r.List()
+	if len(l) != len(want) {
+		t.Fatalf("got %d jobs back, want %d", len(l), len(want))
+	}
+	for i, w := range want {
+		j := l[i]
+		if j.ID != i+1 || j.Name != w.name || j.Status != w.status {
+			t.Errorf("job %d is %d %s %s, want %d %s %s", i, j.ID, j.Name, j.Status, i+1, w.name, w.status)
+		}
+		if src, err := r.source(&j); err != nil || src != w.src {
+			t.Errorf("job %d's source is %q (%v), want %q", j.ID, src, err, w.src)
+		}
+	}
+	if !r.Held() {
+		t.Error("the queue isn't held with jobs left over")
+	}
+	if j := add(t, r, "four", ""); j.ID != 4 {
+		t.Errorf("new job is %d, want 4", j.ID)
+	}
+}
+
+func TestQueueSaveError(t *testing.T) {
+	q, cleanup := testQueue(t, &staubli.Recorder{})
+	defer cleanup()
+	add(t, q, "one", "G1 X1 Y0 Z0\n")
+
+	// The queue can't be saved where there's a directory in the way of its temporary file.
+	if err := os.Mkdir(q.path+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Add(&Job{Name: "two", Source: "G1 X2 Y0 Z0\n"}); err == nil {
+		t.Fatal("added a job to a queue that can't be saved")
+	}
+	if ids := queued(q); !sameIDs(ids, []int{1}) {
+		t.Errorf("queued jobs are %v, want [1]", ids)
+	}
+	fis, err := ioutil.ReadDir(q.sourceDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 || fis[0].Name() != "1" {
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		t.Errorf("sources are %v, want just 1", names)
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	q, cleanup := testQueue(t, &staubli.Recorder{})
+	defer cleanup()
+	for _, name := range []string{"one", "two", "three", "four"} {
+		add(t, q, name, "G1 X1 Y0 Z0\n")
+	}
+
+	if err := q.Move(4, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Move(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if ids := queued(q); !sameIDs(ids, []int{4, 2, 1, 3}) {
+		t.Errorf("after moving, queued jobs are %v, want [4 2 1 3]", ids)
+	}
+	if err := q.Cancel(2); err != nil {
+		t.Fatal(err)
+	}
+	if ids := queued(q); !sameIDs(ids, []int{4, 1, 3}) {
+		t.Errorf("after cancelling, queued jobs are %v, want [4 1 3]", ids)
+	}
+	if err := q.Move(2, 0); err == nil {
+		t.Error("moved a cancelled job")
+	}
+	if err := q.Cancel(2); err == nil {
+		t.Error("cancelled a job twice")
+	}
+	if err := q.Move(5, 0); err == nil {
+		t.Error("moved a job that doesn't exist")
+	}
+
+	q.Hold(true)
+	if j := q.next(); j != nil {
+		t.Errorf("held queue started job %d", j.ID)
+	}
+	q.Hold(false)
+	if j := q.next(); j == nil || j.ID != 4 {
+		t.Errorf("next job is %v, want job 4", j)
+	}
+}
+
+func TestQueueHoldOnFail(t *testing.T) {
+	q, cleanup := testQueue(t, &staubli.Recorder{})
+	defer cleanup()
+	add(t, q, "bad", "G1 X1 Y0 Z0\nG1 X\n")
+	add(t, q, "next", "G1 X3 Y0 Z0\n")
+
+	j := q.next()
+	err := runJob(j)
+	if err == nil {
+		t.Fatal("the job didn't fail")
+	}
+	q.finish(j, err)
+	if j.Status != jobFailed || j.Error == "" {
+		t.Errorf("job is %s (%q), want failed with an error", j.Status, j.Error)
+	}
+	if !q.Held() {
+		t.Error("the queue isn't held after a job failed")
+	}
+	if n := q.next(); n != nil {
+		t.Errorf("job %d started after a failure", n.ID)
+	}
+
+	// Resuming it queues a copy of it that starts from the last line it got to, before the one
+	// that couldn't be read.
+	r, err := q.Resume(j.ID, 0, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Options.From != 1 {
+		t.Errorf("resumed job starts at line %d, want 1", r.Options.From)
+	}
+	if src, err := q.source(r); err != nil || src != "G1 X1 Y0 Z0\nG1 X\n" {
+		t.Errorf("resumed job's source is %q (%v)", src, err)
+	}
+	if ids := queued(q); !sameIDs(ids, []int{2, 3}) {
+		t.Errorf("queued jobs are %v, want [2 3]", ids)
+	}
+
+	// A job that's done doesn't hold the queue.
+	q.Hold(false)
+	j = q.next()
+	q.finish(j, runJob(j))
+	if j.Status != jobDone || q.Held() {
+		t.Errorf("job is %s, and the queue held is %v, want done and not held", j.Status, q.Held())
+	}
+}
+
+// waitFor waits for cond to come true, failing the test if it takes more than a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueueCheckpoint(t *testing.T) {
+	q, cleanup := testQueue(t, &staubli.Recorder{})
+	defer cleanup()
+	add(t, q, "stop", "G1 X1 Y0 Z0\nG1 X2\nM0\nG1 X3\n")
+
+	j := q.next()
+	done := make(chan bool)
+	go func() {
+		q.finish(j, runJob(j))
+		done <- true
+	}()
+	waitFor(t, "the program to pause", executor.Paused)
+
+	q.checkpoint()
+	b, err := ioutil.ReadFile(q.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []Job
+	if err := json.Unmarshal(b, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].Checkpoint != 3 {
+		t.Errorf("saved jobs are %+v, want job 1 at line 3", saved)
+	}
+
+	executor.Resume()
+	<-done
+	if l := q.List(); l[0].Status != jobDone || l[0].Checkpoint != 4 {
+		t.Errorf("job is %s at line %d, want done at line 4", l[0].Status, l[0].Checkpoint)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LHSRobotics/gdmux/pkg/dmux"
+	"github.com/LHSRobotics/gdmux/pkg/staubli"
+)
+
+// Bounds is the box a program's moves stay inside, in its own coordinates.
+type Bounds struct {
+	Min, Max [3]float64
+}
+
+// programInfo is what the library knows about one of its programs.
+type programInfo struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+	Lines    int
+	// Bounds is missing if the program doesn't move, or can't be planned, in which case Error
+	// says why.
+	Bounds *Bounds `json:",omitempty"`
+	Error  string  `json:",omitempty"`
+}
+
+// library is a directory of G-code programs. Working out what's in a program means planning it, so
+// the results are kept until the file changes.
+//
+// Planning is done without holding the lock, so a program that takes a while doesn't hold up the
+// rest of the library, and gives up after planLimit lines, so one that never ends can't take up
+// all the memory.
+type library struct {
+	sync.Mutex
+	dir   string
+	cache map[string]programInfo
+}
+
+var programs *library
+
+// planLimit is the most lines of a program that are run planning it, counting each time a loop
+// runs them. It's well over the longest of the samples.
+const planLimit = 500000
+
+// checkName makes sure name is a plain file name, so it can't reach outside the library.
+func checkName(name string) error {
+	if name == "" {
+		return errors.New("no program name given")
+	}
+	if strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("bad program name: %s", name)
+	}
+	return nil
+}
+
+func (l *library) path(name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(l.dir, name), nil
+}
+
+// List returns what's known about every program, sorted by name, as ReadDir sorts them.
+func (l *library) List() ([]programInfo, error) {
+	fis, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	list := []programInfo{}
+	for _, fi := range fis {
+		if fi.IsDir() || checkName(fi.Name()) != nil {
+			continue
+		}
+		list = append(list, l.info(fi))
+	}
+	return list, nil
+}
+
+// Info returns what's known about the named program.
+func (l *library) Info(name string) (programInfo, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return programInfo{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return programInfo{}, err
+	}
+	return l.info(fi), nil
+}
+
+// info works out what's in a program, unless it's done so since the file last changed.
+func (l *library) info(fi os.FileInfo) programInfo {
+	l.Lock()
+	pi, ok := l.cache[fi.Name()]
+	l.Unlock()
+	if ok && pi.Size == fi.Size() && pi.Modified.Equal(fi.ModTime()) {
+		return pi
+	}
+
+	pi = programInfo{Name: fi.Name(), Size: fi.Size(), Modified: fi.ModTime()}
+	b, err := ioutil.ReadFile(filepath.Join(l.dir, fi.Name()))
+	if err != nil {
+		pi.Error = err.Error()
+		return pi
+	}
+	pi.Lines = bytes.Count(b, []byte("\n"))
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		pi.Lines++
+	}
+
+	// Plan it on a level table with its zero at the origin, and nothing else set up, so the
+	// positions are the program's own.
+	e := dmux.New(staubli.Dummy, dmux.Options{Log: func(string) {}, PlanLimit: planLimit})
+	if plan, err := e.Plan(bytes.NewReader(b)); err != nil {
+		pi.Error = err.Error()
+	} else if min, max, ok := plan.Bounds(); ok {
+		pi.Bounds = &Bounds{Min: min, Max: max}
+	}
+	l.Lock()
+	l.cache[fi.Name()] = pi
+	l.Unlock()
+	return pi
+}
+
+// Read returns the source of the named program.
+func (l *library) Read(name string) ([]byte, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(p)
+}
+
+// Save stores the program read from r under name, replacing any program that's there already.
+func (l *library) Save(name string, r io.Reader) error {
+	p, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a failed upload doesn't leave half a program behind.
+	// Its name starts with a dot, so it's not listed in the meantime.
+	tmp := filepath.Join(l.dir, "."+name+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// Delete removes the named program.
+func (l *library) Delete(name string) error {
+	p, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	delete(l.cache, name)
+	l.Unlock()
+	return os.Remove(p)
+}
+
+// Rename renames a program, as long as there isn't one called to already.
+func (l *library) Rename(name, to string) error {
+	p, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	q, err := l.path(to)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(p); err != nil {
+		return err
+	}
+	if _, err := os.Stat(q); err == nil {
+		return fmt.Errorf("there's already a program called %s", to)
+	}
+	l.Lock()
+	delete(l.cache, name)
+	l.Unlock()
+	return os.Rename(p, q)
+}
+
+// libraryError sends err back with a status code to suit it.
+func libraryError(w http.ResponseWriter, err error) {
+	code := http.StatusBadRequest
+	if os.IsNotExist(err) {
+		code = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// handleLibrary lists the programs in the library as JSON.
+func handleLibrary(w http.ResponseWriter, r *http.Request) {
+	list, err := programs.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleLibraryUpload stores the files uploaded as "file" in a multipart form, and sends back what
+// the library makes of them as JSON. A single file can be given another name with the "name" form
+// value.
+func handleLibraryUpload(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		http.Error(w, "no file uploaded", http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("name")
+	if name != "" && len(files) > 1 {
+		http.Error(w, "can't give several files the same name", http.StatusBadRequest)
+		return
+	}
+
+	infos := []programInfo{}
+	for _, fh := range files {
+		n := name
+		if n == "" {
+			n = filepath.Base(fh.Filename)
+		}
+		f, err := fh.Open()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = programs.Save(n, f)
+		f.Close()
+		if err != nil {
+			libraryError(w, err)
+			return
+		}
+		pi, err := programs.Info(n)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		infos = append(infos, pi)
+		weblog(fmt.Sprintf("Got program %s (%d bytes) from %s\n", n, pi.Size, r.RemoteAddr))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// handleLibraryGet sends back the source of the program given by the "name" form value.
+func handleLibraryGet(w http.ResponseWriter, r *http.Request) {
+	b, err := programs.Read(r.FormValue("name"))
+	if err != nil {
+		libraryError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(b)
+}
+
+// handleLibraryDelete deletes the program given by the "name" form value.
+func handleLibraryDelete(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if err := programs.Delete(name); err != nil {
+		libraryError(w, err)
+		return
+	}
+	weblog(fmt.Sprintf("Got request from %s to delete %s\n", r.RemoteAddr, name))
+}
+
+// handleLibraryRename renames the program given by the "name" form value to "to".
+func handleLibraryRename(w http.ResponseWriter, r *http.Request) {
+	name, to := r.FormValue("name"), r.FormValue("to")
+	if err := programs.Rename(name, to); err != nil {
+		libraryError(w, err)
+		return
+	}
+	weblog(fmt.Sprintf("Got request from %s to rename %s to %s\n", r.RemoteAddr, name, to))
+}
+
+// initLibrary makes sure the library's directory is there.
+func initLibrary() {
+	if err := os.MkdirAll(*libraryDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	programs = &library{dir: *libraryDir, cache: make(map[string]programInfo)}
+}
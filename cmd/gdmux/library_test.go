@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ok   bool
+	}{
+		{"box.nc", true},
+		{"box lid (2).gcode", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{".hidden.nc", false},
+		{"../box.nc", false},
+		{"../../etc/passwd", false},
+		{"sub/box.nc", false},
+		{`..\box.nc`, false},
+		{"/etc/passwd", false},
+	} {
+		if err := checkName(tc.name); (err == nil) != tc.ok {
+			t.Errorf("checkName(%q) = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestLibrary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdmux-library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := &library{dir: dir, cache: make(map[string]programInfo)}
+
+	if err := l.Save("box.nc", strings.NewReader("G1 X10 Y0 Z0\nG1 Y20\nG0 Z5")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Save("../box.nc", strings.NewReader("G1 X1\n")); err == nil {
+		t.Error("saved a program outside the library")
+	}
+	list, err := l.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("got %d programs, want 1", len(list))
+	}
+	pi := list[0]
+	if pi.Name != "box.nc" || pi.Lines != 3 || pi.Bounds == nil {
+		t.Fatalf("got %+v, want box.nc with 3 lines and bounds", pi)
+	}
+	if b := *pi.Bounds; b.Min != [3]float64{10, 0, 0} || b.Max != [3]float64{10, 20, 5} {
+		t.Errorf("got bounds %v, want [10 0 0] to [10 20 5]", b)
+	}
+
+	if err := l.Rename("box.nc", "lid.nc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Read("box.nc"); !os.IsNotExist(err) {
+		t.Errorf("reading the old name gives %v, want that it doesn't exist", err)
+	}
+	if err := l.Save("box.nc", strings.NewReader("G1 X1\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Rename("box.nc", "lid.nc"); err == nil {
+		t.Error("renamed a program over another")
+	}
+	if err := l.Delete("lid.nc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Info("lid.nc"); !os.IsNotExist(err) {
+		t.Errorf("deleted program's info gives %v, want that it doesn't exist", err)
+	}
+}
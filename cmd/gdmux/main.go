@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -14,6 +13,8 @@ import (
 	"code.google.com/p/go.net/websocket"
 	"github.com/tarm/goserial"
 
+	"github.com/LHSRobotics/gdmux/pkg/dmux"
+	"github.com/LHSRobotics/gdmux/pkg/extruder"
 	"github.com/LHSRobotics/gdmux/pkg/staubli"
 	"github.com/LHSRobotics/gdmux/pkg/vplus"
 )
@@ -30,93 +31,63 @@ var (
 	originy = flag.Float64("y", 0, "y coordinates for the origin")
 	originz = flag.Float64("z", -100, "z coordinates for the origin")
 
-	dummy       = flag.Bool("dummy", false, "don't actually send commands to the arm")
-	httpAddr    = flag.String("http", "", "tcp address on which to listen")
+	stateFile  = flag.String("state", os.Getenv("HOME")+"/.gdmux.json", "file to keep the work offsets in")
+	queueFile  = flag.String("queue", os.Getenv("HOME")+"/.gdmux-queue.json", "file to keep the job queue in")
+	libraryDir = flag.String("library", os.Getenv("HOME")+"/gdmux-programs", "directory to keep uploaded programs in")
+	wcsFlag    = flag.String("wcs", "", "work coordinate system to select on startup (G54 to G59)")
+
+	heightMapFile = flag.String("heightmap", "", "CSV or JSON height map of the work surface to follow")
+	meshStep      = flag.Float64("meshstep", 5, "split straight moves into steps this long to follow the height map")
+	angleStep     = flag.Float64("anglestep", 5, "split straight moves that turn the tool into steps of this many degrees")
+
+	toolFile = flag.String("tools", "", "JSON tool table")
+	toolFlag = flag.Int("tool", 0, "tool that's on the arm at startup")
+	ioFile   = flag.String("io", "", "JSON file saying which controller signals the end effector uses")
+
+	parkFile = flag.String("park", "", "JSON file with the safe height and park positions for G28 and G30")
+
+	plotterFile = flag.String("plotter", "", "JSON pen plotter profile, for drawing with a pen")
+
+	ttyExtruder  = flag.String("extrudertty", "", "serial tty to the extruder controller, for 3D printing")
+	baudExtruder = flag.Int("extruderrate", 115200, "baud rate for the extruder controller")
+
+	optionalStopFlag = flag.Bool("optionalstop", false, "pause at optional stops (M1)")
+
+	planFlag    = flag.Bool("plan", false, "print the motion plans of the gcode files as JSON instead of running them")
+	runPlanFlag = flag.Bool("runplan", false, "run files saved by -plan rather than gcode")
+	fromFlag    = flag.Int("from", 0, "resume the program from this line, making a safe approach to where it was")
+
+	dummy     = flag.Bool("dummy", false, "don't actually send commands to the arm")
+	httpAddr  = flag.String("http", "", "tcp address on which to listen")
 	sendvplus = flag.Bool("sendv", false, "send over the V+ code on startup")
-	verbose     = flag.Bool("verbose", false, "print lots output")
-	dataRoot    = flag.String("root",
+	verbose   = flag.Bool("verbose", false, "print lots output")
+	dataRoot  = flag.String("root",
 		strings.Split(os.Getenv("GOPATH"), ":")[0]+"/src/github.com/LHSRobotics/gdmux",
 		"repository root to find static files")
 
-	arm     staubli.Arm
-	running = false
+	arm      staubli.Arm
+	executor *dmux.Executor
+	tools    *dmux.ToolTable
 )
 
 var sessionLock = sync.Mutex{}
 
+// handleRun queues the posted G-code to be run. See jobFromRequest for the parameters it takes.
 func handleRun(w http.ResponseWriter, r *http.Request) {
-	// TODO: communicate the running state to js, so the right buttons get enabled/disabled.
-	if running {
-		weblog(fmt.Sprintf("Got run request from %s, but the arm is already running.\n", r.RemoteAddr))
-		return
-	}
-	weblog(fmt.Sprintf("Got run request from %s\n", r.RemoteAddr))
-	sessionLock.Lock()
-	running = true
-	fmt.Println("comingata")
-	weblog("RUNNING GCODE!\n")
-	dmux(r.Body)
-	running = false
-	sessionLock.Unlock()
-	weblog("Done.\n")
+	submitJob(w, r, false)
 }
 
 func handleStop(w http.ResponseWriter, r *http.Request) {
-	if running {
+	if executor.Running() {
 		weblog(fmt.Sprintf("Got stop request from %s\n", r.RemoteAddr))
-		running = false
+		jobs.cancelCurrent()
+		executor.Stop()
 		weblog("Stopped sending Gcode\n")
 	} else {
 		weblog(fmt.Sprintf("Got stop request from %s, but the arm isn't running.\n", r.RemoteAddr))
 	}
 }
 
-var clients struct {
-	sync.Mutex
-	m map[chan string]bool
-}
-
-var logc = make(chan string, 100)
-
-func weblog(msg string) {
-	log.Printf("%s", msg)
-	logc <- msg
-}
-
-func logger() {
-	for {
-		msg := <-logc
-		for c, _ := range clients.m {
-			select {
-			case c <- msg:
-			default:
-			}
-		}
-	}
-}
-
-func handleLog(ws *websocket.Conn) {
-	var msgc = make(chan string, 200)
-
-	// TODO: Move this to weblog.Register()/Unregister() methods?
-	clients.Lock()
-	clients.m[msgc] = true
-	clients.Unlock()
-	defer func() {
-		clients.Lock()
-		delete(clients.m, msgc)
-		clients.Unlock()
-	}()
-
-	enc := json.NewEncoder(ws)
-	for {
-		err := enc.Encode(<-msgc)
-		if err != nil {
-			break
-		}
-	}
-}
-
 func sendPg() {
 	log.Println("Sending over V+ code")
 	s, err := serial.OpenPort(&serial.Config{Name: *ttyConsole, Baud: *baudConsole})
@@ -149,9 +120,75 @@ func sendPg() {
 }
 
 func initArm() {
-	origin.x, origin.y, origin.z = *originx, *originy, *originz
+	initWCS()
+	opts := dmux.Options{
+		Log:          weblog,
+		Events:       events.publish,
+		Verbose:      *verbose,
+		MeshStep:     *meshStep,
+		AngleStep:    *angleStep,
+		WCS:          wcs,
+		Tools:        dmux.NewToolTable(),
+		OptionalStop: *optionalStopFlag,
+	}
+	if *httpAddr == "" {
+		opts.Console = os.Stdin
+	}
+
+	if *heightMapFile != "" {
+		m, err := dmux.LoadHeightMap(*heightMapFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.HeightMap = m
+	}
 
-	if *dummy {
+	if *toolFile != "" {
+		t, err := dmux.LoadTools(*toolFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Tools = t
+	}
+	if err := opts.Tools.Mount(*toolFlag); err != nil {
+		log.Fatal(err)
+	}
+	tools = opts.Tools
+
+	if *ioFile != "" {
+		sc, err := dmux.LoadSignals(*ioFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Signals = sc
+	}
+
+	if *parkFile != "" {
+		pc, err := dmux.LoadPark(*parkFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Park = pc
+	}
+
+	if *plotterFile != "" {
+		p, err := dmux.LoadPlotter(*plotterFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Plotter = p
+	}
+
+	if *ttyExtruder != "" {
+		log.Println("Opening ", *ttyExtruder)
+		s, err := serial.OpenPort(&serial.Config{Name: *ttyExtruder, Baud: *baudExtruder})
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Extruder = extruder.NewExtruder(s)
+	}
+
+	if *dummy || *planFlag {
 		arm = staubli.Dummy
 	} else {
 		log.Println("Opening ", *ttyData)
@@ -161,6 +198,7 @@ func initArm() {
 		}
 		arm = staubli.NewStaubli(s)
 	}
+	executor = dmux.New(arm, opts)
 
 	if *sendvplus {
 		sendPg()
@@ -175,14 +213,37 @@ func main() {
 	}
 	flag.Parse()
 
-	go logger()
-
 	if *httpAddr != "" {
-		clients.m = make(map[chan string]bool)
 		initArm()
+		initLibrary()
+		initJobs()
 		log.Println("Listening on ", *httpAddr)
 		http.HandleFunc("/run", handleRun)
 		http.HandleFunc("/stop", handleStop)
+		http.HandleFunc("/plan", handlePlan)
+		http.HandleFunc("/runplan", handleRunPlan)
+		http.HandleFunc("/api/status", handleStatus)
+		http.HandleFunc("/jobs", handleJobs)
+		http.HandleFunc("/jobs/move", handleJobMove)
+		http.HandleFunc("/jobs/cancel", handleJobCancel)
+		http.HandleFunc("/jobs/clear", handleJobClear)
+		http.HandleFunc("/jobs/hold", handleJobHold)
+		http.HandleFunc("/jobs/resume", handleJobResume)
+		http.HandleFunc("/library", handleLibrary)
+		http.HandleFunc("/library/upload", handleLibraryUpload)
+		http.HandleFunc("/library/get", handleLibraryGet)
+		http.HandleFunc("/library/delete", handleLibraryDelete)
+		http.HandleFunc("/library/rename", handleLibraryRename)
+		http.HandleFunc("/resume", handleResume)
+		http.HandleFunc("/optionalstop", handleOptionalStop)
+		http.HandleFunc("/message", handleMessage)
+		http.HandleFunc("/wcs", handleWCS)
+		http.HandleFunc("/wcs/select", handleWCSSelect)
+		http.HandleFunc("/wcs/set", handleWCSSet)
+		http.HandleFunc("/plane", handlePlane)
+		http.HandleFunc("/plane/touch", handlePlaneTouch)
+		http.HandleFunc("/plane/apply", handlePlaneApply)
+		http.HandleFunc("/plane/clear", handlePlaneClear)
 		http.Handle("/log", websocket.Handler(handleLog))
 		http.Handle("/", http.FileServer(http.Dir(*dataRoot+"/cmd/gdmux/ui")))
 		log.Fatal(http.ListenAndServe(*httpAddr, nil))
@@ -194,12 +255,31 @@ func main() {
 	}
 
 	initArm()
-	running = true
 	for _, fn := range flag.Args() {
 		f, err := os.Open(fn)
 		if err != nil {
 			log.Fatal(err)
 		}
-		dmux(f)
+		switch {
+		case *planFlag:
+			p, err := executor.Plan(f)
+			if err != nil {
+				log.Fatalf("%s: %s", fn, err)
+			}
+			p.WriteJSON(os.Stdout)
+		case *runPlanFlag:
+			p, err := dmux.ReadPlan(f)
+			if err != nil {
+				log.Fatalf("%s: %s", fn, err)
+			}
+			if err := executor.RunPlanFrom(p, *fromFlag); err != nil {
+				log.Fatal(err)
+			}
+		default:
+			if err := executor.RunFrom(f, *fromFlag); err != nil {
+				log.Fatal(err)
+			}
+		}
+		f.Close()
 	}
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/LHSRobotics/gdmux/pkg/dmux"
+)
+
+// touched holds the points recorded so far for calibrating the work plane.
+var touched struct {
+	sync.Mutex
+	p  [3][3]float64
+	ok [3]bool
+}
+
+// planeStatus is what /plane reports.
+type planeStatus struct {
+	Touched [3]*[3]float64
+	Plane   [3][3]float64
+}
+
+// handlePlane reports the touched points and the work plane currently in use, as JSON.
+func handlePlane(w http.ResponseWriter, r *http.Request) {
+	var st planeStatus
+	touched.Lock()
+	for i := range touched.p {
+		if touched.ok[i] {
+			p := touched.p[i]
+			st.Touched[i] = &p
+		}
+	}
+	touched.Unlock()
+	st.Plane = wcs.Plane().Matrix()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// handlePlaneTouch records the arm's current position as the n-th calibration point, for n given
+// by the "n" form value. The first point is the new zero, the second lies along the x axis and
+// the third anywhere else on the surface.
+//
+// The arm reports where its flange is, which is only where the table is without a tool, so
+// touches are refused while one's mounted.
+func handlePlaneTouch(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.FormValue("n"))
+	if err != nil || n < 1 || n > 3 {
+		http.Error(w, "n must be 1, 2 or 3", http.StatusBadRequest)
+		return
+	}
+	if executor.Running() {
+		http.Error(w, "the arm is running", http.StatusConflict)
+		return
+	}
+	if t := tools.Mounted(); t != nil {
+		http.Error(w, fmt.Sprintf("tool %d is mounted: touch the table with the flange, with no tool", t.ID), http.StatusConflict)
+		return
+	}
+
+	sessionLock.Lock()
+	err = arm.Break()
+	x, y, z := arm.Position()
+	sessionLock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	touched.Lock()
+	touched.p[n-1], touched.ok[n-1] = [3]float64{x, y, z}, true
+	touched.Unlock()
+	weblog(fmt.Sprintf("Touched point %d at %8.2f %8.2f %8.2f\n", n, x, y, z))
+}
+
+// handlePlaneApply works out the work plane from the three touched points and starts using it,
+// with the first point as the zero of the active coordinate system.
+func handlePlaneApply(w http.ResponseWriter, r *http.Request) {
+	touched.Lock()
+	p, ok := touched.p, touched.ok
+	touched.Unlock()
+	if !ok[0] || !ok[1] || !ok[2] {
+		http.Error(w, "touch all three points first", http.StatusBadRequest)
+		return
+	}
+
+	f, err := dmux.PlaneFrame(p[0], p[1], p[2])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := wcs.SetPlane(p[0], f); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	n := f.Normal()
+	weblog(fmt.Sprintf("Work plane normal is now %6.3f %6.3f %6.3f\n", n[0], n[1], n[2]))
+}
+
+// handlePlaneClear goes back to assuming the table is level with the arm.
+func handlePlaneClear(w http.ResponseWriter, r *http.Request) {
+	if err := wcs.SetPlane(wcs.Zero(), dmux.Level); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	weblog("Work plane is level again\n")
+}
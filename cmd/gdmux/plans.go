@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+)
+
+// handlePlan works out the motion plan of the posted G-code, and sends it back as JSON without
+// moving the arm.
+func handlePlan(w http.ResponseWriter, r *http.Request) {
+	p, err := executor.Plan(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w)
+}
+
+// handleRunPlan queues a motion plan posted as JSON, as /plan gives them, to be run. It takes the
+// same parameters as /run.
+func handleRunPlan(w http.ResponseWriter, r *http.Request) {
+	submitJob(w, r, true)
+}
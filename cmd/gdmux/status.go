@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// apiStatus is what /api/status reports.
+type apiStatus struct {
+	// State is "running", "paused" or "idle".
+	State string
+	// Job is the job being run, if there is one.
+	Job *jobSummary `json:",omitempty"`
+	// Queued is how many jobs are waiting, and Held whether the queue is held.
+	Queued int
+	Held   bool
+
+	// Line is the line being run, of Lines, and Percent how far through them that is. They're
+	// left at the end of the last program once it's done.
+	Line, Lines int
+	Percent     float64
+	// Elapsed is how many seconds the program has been running for, and Remaining roughly how
+	// many are left, going by how long it's taken so far. Both are missing if nothing's running.
+	Elapsed   *float64 `json:",omitempty"`
+	Remaining *float64 `json:",omitempty"`
+
+	// Position is where the arm last said it was, in arm coordinates, and Located when.
+	Position [3]float64
+	Located  *time.Time `json:",omitempty"`
+
+	// WCS is the active work coordinate system, and Origin its zero point.
+	WCS    string
+	Origin [3]float64
+
+	Message string `json:",omitempty"`
+}
+
+// handleStatus reports what gdmux is up to as JSON, for dashboards and scripts to poll.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	p := executor.Progress()
+	ws := wcs.State()
+	st := apiStatus{
+		State:    "idle",
+		Line:     p.Line,
+		Lines:    p.Lines,
+		Position: p.Position,
+		WCS:      ws.Active,
+		Origin:   ws.Systems[ws.Active],
+		Message:  executor.Message(),
+	}
+	if p.Lines > 0 {
+		st.Percent = 100 * float64(p.Line) / float64(p.Lines)
+	}
+	if !p.Located.IsZero() {
+		st.Located = &p.Located
+	}
+
+	if p.Running {
+		st.State = "running"
+		if p.Paused {
+			st.State = "paused"
+		}
+		elapsed := time.Since(p.Started).Seconds()
+		st.Elapsed = &elapsed
+		if p.Line > 0 && p.Lines > 0 {
+			left := elapsed * float64(p.Lines-p.Line) / float64(p.Line)
+			st.Remaining = &left
+		}
+	}
+
+	st.Job, st.Queued, st.Held = jobs.status()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
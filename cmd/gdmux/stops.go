@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+func handleResume(w http.ResponseWriter, r *http.Request) {
+	if !executor.Resume() {
+		weblog(fmt.Sprintf("Got resume request from %s, but the program isn't paused.\n", r.RemoteAddr))
+		return
+	}
+	weblog(fmt.Sprintf("Got resume request from %s\n", r.RemoteAddr))
+}
+
+// handleOptionalStop turns optional stops on or off, going by the "on" form value.
+func handleOptionalStop(w http.ResponseWriter, r *http.Request) {
+	on, err := strconv.ParseBool(r.FormValue("on"))
+	if err != nil {
+		http.Error(w, "on must be true or false", http.StatusBadRequest)
+		return
+	}
+	executor.SetOptionalStop(on)
+	if on {
+		weblog("Optional stops (M1) are on\n")
+	} else {
+		weblog("Optional stops (M1) are off\n")
+	}
+}
+
+// stopStatus is what /message reports.
+type stopStatus struct {
+	Paused       bool
+	OptionalStop bool
+	Message      string
+}
+
+// handleMessage reports the last M117 message, and whether the program is paused, as JSON.
+func handleMessage(w http.ResponseWriter, r *http.Request) {
+	st := stopStatus{
+		Paused:       executor.Paused(),
+		OptionalStop: executor.OptionalStop(),
+		Message:      executor.Message(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
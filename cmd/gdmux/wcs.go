@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/LHSRobotics/gdmux/pkg/dmux"
+)
+
+// wcs holds the zero points of the work coordinate systems.
+var wcs *dmux.WorkOffsets
+
+// handleWCS reports the work offsets as JSON.
+func handleWCS(w http.ResponseWriter, r *http.Request) {
+	st := wcs.State()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// handleWCSSelect makes the coordinate system given by the "system" form value the active one.
+func handleWCSSelect(w http.ResponseWriter, r *http.Request) {
+	i, err := dmux.WCSIndex(r.FormValue("system"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := wcs.Select(i); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	weblog(fmt.Sprintf("Got %s request from %s\n", dmux.WCSNames[i], r.RemoteAddr))
+}
+
+// handleWCSSet changes the zero point of the coordinate system given by the "system" form value to
+// the "x", "y" and "z" form values. Axes that aren't given are left as they are.
+func handleWCSSet(w http.ResponseWriter, r *http.Request) {
+	i, err := dmux.WCSIndex(r.FormValue("system"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	z := wcs.Get(i)
+	for _, v := range []struct {
+		name string
+		p    *float64
+	}{{"x", &z[0]}, {"y", &z[1]}, {"z", &z[2]}} {
+		s := r.FormValue(v.name)
+		if s == "" {
+			continue
+		}
+		if *v.p, err = strconv.ParseFloat(s, 64); err != nil {
+			http.Error(w, fmt.Sprintf("bad %s coordinate: %s", v.name, s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := wcs.Set(i, z); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	weblog(fmt.Sprintf("Got request from %s to set %s to %8.2f %8.2f %8.2f\n",
+		r.RemoteAddr, dmux.WCSNames[i], z[0], z[1], z[2]))
+}
+
+// initWCS loads the work offsets and applies the command line flags to them.
+func initWCS() {
+	var err error
+	def := [3]float64{*originx, *originy, *originz}
+	wcs, err = dmux.LoadWCS(*stateFile, def)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *wcsFlag != "" {
+		i, err := dmux.WCSIndex(*wcsFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := wcs.Select(i); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Explicitly given origin flags override the stored zero of the active system.
+	z, set := wcs.Get(-1), false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "x":
+			z[0], set = *originx, true
+		case "y":
+			z[1], set = *originy, true
+		case "z":
+			z[2], set = *originz, true
+		}
+	})
+	if set {
+		if err := wcs.Set(-1, z); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
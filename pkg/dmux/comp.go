@@ -0,0 +1,347 @@
+package dmux
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/LHSRobotics/gdmux/pkg/gcode"
+	"github.com/LHSRobotics/gdmux/pkg/staubli"
+)
+
+// Cutter radius compensation (G41 and G42) moves the tool sideways off the programmed path by the
+// tool's radius, to the left or right of the direction of travel, so the edge of the tool follows
+// the path rather than its centre. Only X and Y are offset.
+//
+// Where two moves meet, the end of the first depends on the second: on the inside of a corner the
+// offset paths cross, and the tool stops there; on the outside they don't meet, and the tool goes
+// round the corner on an arc. So each compensated move waits, in c.pending, until the next one
+// comes along. Anything other than a move ends the wait, leaving the tool straight out from the
+// end of the move, as does G40.
+
+// compCodes are the moves that are compensated.
+var compCodes = map[gcode.Code]bool{"G0": true, "G1": true, "G2": true, "G3": true}
+
+// segment is a compensated move.
+type segment struct {
+	code gcode.Code
+	// line is the line the move is on, which it's reported against when it's made, even if the
+	// program has moved on by then.
+	line *gcode.Line
+	// start, end and centre are the programmed path, in program coordinates. The centre is
+	// only used by arcs.
+	start, end, centre point
+	// r is how far the tool goes to the left of the path, and so to the right when negative.
+	r float64
+	// from and to are where the tool actually goes.
+	from, to point
+	// then are the moves straight up or down that come after this one, before the next.
+	then []*segment
+}
+
+// flat reports whether the segment doesn't move in X or Y, and so has no direction to be offset
+// from.
+func (s *segment) flat() bool {
+	return math.Hypot(s.end.x-s.start.x, s.end.y-s.start.y) < 1e-9
+}
+
+// tangent returns the direction of travel, in X and Y, at the point p on the segment.
+func (s *segment) tangent(p point) point {
+	var t point
+	switch s.code {
+	case "G2":
+		t = point{x: p.y - s.centre.y, y: s.centre.x - p.x}
+	case "G3":
+		t = point{x: s.centre.y - p.y, y: p.x - s.centre.x}
+	default:
+		t = point{x: s.end.x - s.start.x, y: s.end.y - s.start.y}
+	}
+	return t.scale(1 / t.norm())
+}
+
+// offset returns p moved r to the left of the direction t.
+func offset(p, t point, r float64) point {
+	p.x -= t.y * r
+	p.y += t.x * r
+	return p
+}
+
+// cross2 is the z component of the cross product of p and q.
+func cross2(p, q point) float64 {
+	return p.x*q.y - p.y*q.x
+}
+
+// offsetPath is the offset path of a segment near one of its ends: a line through p in direction
+// t or, for arcs, a circle around centre.
+type offsetPath struct {
+	arc    bool
+	p, t   point
+	centre point
+	radius float64
+}
+
+// pathAt returns the offset path of s through q, the offset of one of its ends.
+func (s *segment) pathAt(q point) offsetPath {
+	q.z = 0
+	if s.code == "G2" || s.code == "G3" {
+		c := point{x: s.centre.x, y: s.centre.y}
+		return offsetPath{arc: true, centre: c, radius: q.sub(c).norm()}
+	}
+	return offsetPath{p: q, t: s.tangent(q)}
+}
+
+// intersect returns the points, in X and Y, where two offset paths cross.
+func intersect(a, b offsetPath) []point {
+	switch {
+	case !a.arc && !b.arc:
+		den := cross2(a.t, b.t)
+		if math.Abs(den) < 1e-9 {
+			return nil
+		}
+		u := cross2(b.p.sub(a.p), b.t) / den
+		return []point{a.p.add(a.t.scale(u))}
+	case a.arc && !b.arc:
+		return intersect(b, a)
+	case !a.arc && b.arc:
+		f := a.p.sub(b.centre)
+		ft := f.dot(a.t)
+		disc := ft*ft - (f.dot(f) - b.radius*b.radius)
+		if disc < 0 {
+			return nil
+		}
+		sq := math.Sqrt(disc)
+		return []point{a.p.add(a.t.scale(-ft + sq)), a.p.add(a.t.scale(-ft - sq))}
+	}
+
+	v := b.centre.sub(a.centre)
+	d := v.norm()
+	if d < 1e-9 || d > a.radius+b.radius || d < math.Abs(a.radius-b.radius) {
+		return nil
+	}
+	l := (a.radius*a.radius - b.radius*b.radius + d*d) / (2 * d)
+	h := math.Sqrt(math.Max(0, a.radius*a.radius-l*l))
+	mid := a.centre.add(v.scale(l / d))
+	n := point{x: -v.y / d, y: v.x / d}
+	return []point{mid.add(n.scale(h)), mid.sub(n.scale(h))}
+}
+
+// compensating reports whether the current line carries on along the compensated path, by
+// having moves and nothing else.
+func (c *Cmd) compensating() bool {
+	if c.comp == "" {
+		return false
+	}
+	for _, code := range c.line.Codes {
+		if (code[0] == 'G' || code[0] == 'M') && !compCodes[code] {
+			return false
+		}
+	}
+	return true
+}
+
+// compRadius returns the radius of the tool given by D, or of the mounted tool if there's no D.
+// D0 turns compensation off, without leaving G41 or G42.
+func (c *Cmd) compRadius() (float64, error) {
+	t := c.tools.Mounted()
+	if d, ok := c.env['D']; ok {
+		if d == 0 {
+			return 0, nil
+		}
+		var err error
+		if t, err = c.tools.Get(int(d)); err != nil {
+			return 0, err
+		}
+	}
+	if t == nil {
+		return 0, fmt.Errorf("no tool mounted")
+	}
+	return t.Diameter / 2, nil
+}
+
+// compensate takes the move on the current line, and makes the one before it now that it knows
+// where that has to end.
+func (c *Cmd) compensate(code gcode.Code) {
+	c.Log(fmt.Sprintf("%s %s, compensated", code, c.describe()))
+	if err := c.addSegment(code); err != nil {
+		c.Log(fmt.Sprintf(" → %s\n", err))
+		c.m.stop()
+		return
+	}
+	c.Log(" → OK\n")
+}
+
+func (c *Cmd) addSegment(code gcode.Code) error {
+	r, err := c.compRadius()
+	if err != nil {
+		return err
+	}
+	if c.comp == "G42" {
+		r = -r
+	}
+
+	s := &segment{code: code, line: c.line, start: c.start, end: c.pos(), r: r}
+	if code == "G2" || code == "G3" {
+		s.centre = point{x: c.env['I'], y: c.env['J']}
+		if !c.arcAbsolute {
+			s.centre = s.centre.add(c.start)
+		}
+	}
+
+	if s.flat() {
+		if c.pending != nil {
+			c.pending.then = append(c.pending.then, s)
+			return nil
+		}
+		s.from = c.at
+		s.to = c.at
+		s.to.z, s.to.a, s.to.b, s.to.c = s.end.z, s.end.a, s.end.b, s.end.c
+		return c.cut(s)
+	}
+
+	a := c.pending
+	if a != nil && a.r*r < 0 {
+		// Switching sides: leave the last move square, and come in again from there.
+		if err := c.flush(); err != nil {
+			return err
+		}
+		a = nil
+	}
+	if a == nil {
+		if code == "G2" || code == "G3" {
+			return fmt.Errorf("the first compensated move has to be straight")
+		}
+		s.from = c.at
+		c.pending = s
+		return nil
+	}
+
+	join, err := corner(a, s)
+	if err != nil {
+		return err
+	}
+	if err := c.cutAll(a); err != nil {
+		return err
+	}
+	if join != nil {
+		if err := c.cut(join); err != nil {
+			return err
+		}
+	}
+	c.pending = s
+	return nil
+}
+
+// corner works out where a ends and b starts, and the arc around the corner between them if
+// they're on the outside of it.
+func corner(a, b *segment) (*segment, error) {
+	ta, tb := a.tangent(a.end), b.tangent(b.start)
+	ea, sb := offset(a.end, ta, a.r), offset(b.start, tb, b.r)
+	a.to, b.from = ea, sb
+
+	turn := cross2(ta, tb)
+	if math.Abs(turn) < 1e-9 && ta.dot(tb) > 0 || a.r == 0 {
+		// Carrying straight on.
+		return nil, nil
+	}
+	if turn*a.r > 0 {
+		// The inside of the corner, where the offset paths cross. Of the places they cross, the
+		// one nearest the corner is the one that matters.
+		var best point
+		found := false
+		for _, p := range intersect(a.pathAt(ea), b.pathAt(sb)) {
+			q := point{x: a.end.x, y: a.end.y}
+			if !found || p.sub(q).norm() < best.sub(q).norm() {
+				best, found = p, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("the tool is too big for the corner at %.2f %.2f", a.end.x, a.end.y)
+		}
+		a.to.x, a.to.y = best.x, best.y
+		b.from = a.to
+		return nil, nil
+	}
+
+	// The outside of the corner: go round it.
+	code := gcode.Code("G3")
+	if a.r > 0 {
+		code = "G2"
+	}
+	return &segment{code: code, line: a.line, start: ea, end: sb, centre: a.end, from: ea, to: sb}, nil
+}
+
+// flush makes the pending move, ending straight out from its end.
+func (c *Cmd) flush() error {
+	s := c.pending
+	c.pending = nil
+	s.to = offset(s.end, s.tangent(s.end), s.r)
+	return c.cutAll(s)
+}
+
+// cutAll makes the move s, and the moves up or down that follow it.
+func (c *Cmd) cutAll(s *segment) error {
+	if err := c.cut(s); err != nil {
+		return err
+	}
+	at := s.to
+	for _, z := range s.then {
+		z.from, z.to = at, at
+		z.to.z, z.to.a, z.to.b, z.to.c = z.end.z, z.end.a, z.end.b, z.end.c
+		if err := c.cut(z); err != nil {
+			return err
+		}
+		at = z.to
+	}
+	return nil
+}
+
+// cut moves the arm along s, from s.from to s.to, by setting up the line's position as if the
+// program had asked for the move itself. A move held back from an earlier line is made as part of
+// that line, as far as progress and plans go.
+func (c *Cmd) cut(s *segment) error {
+	if cur := c.line; s.line != cur {
+		c.m.progress(s.line.Number, c.lines)
+		c.line = s.line
+		defer func() { c.line = cur }()
+	}
+	saved := make(map[byte]float64)
+	for _, v := range []byte("XYZABCIJK") {
+		saved[v] = c.env[v]
+	}
+	start := c.start
+	defer func() {
+		for v, x := range saved {
+			c.env[v] = x
+		}
+		c.start = start
+	}()
+
+	c.start = s.from
+	c.env['X'], c.env['Y'], c.env['Z'] = s.to.x, s.to.y, s.to.z
+	c.env['A'], c.env['B'], c.env['C'] = s.to.a, s.to.b, s.to.c
+
+	var err error
+	switch s.code {
+	case "G0":
+		err = c.move()
+	case "G1":
+		err = c.moveStraight()
+	default:
+		centre := s.centre.sub(s.from)
+		if c.arcAbsolute {
+			centre = s.centre
+		}
+		c.env['I'], c.env['J'], c.env['K'] = centre.x, centre.y, 0
+		if c.arcAbsolute {
+			c.env['K'] = s.from.z
+		}
+		direction := float64(staubli.Anticlockwise)
+		if s.code == "G2" {
+			direction = staubli.Clockwise
+		}
+		err = c.arc(direction)
+	}
+	if err != nil {
+		return err
+	}
+	return c.m.Break()
+}
@@ -0,0 +1,127 @@
+package dmux
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/LHSRobotics/gdmux/pkg/gcode"
+)
+
+// peckClearance is how far above the bottom of the last peck G83 stops rapiding back down, before
+// feeding in again.
+const peckClearance = 0.25
+
+// cycleCodes are the canned cycles. Once one has been used, every line that moves X or Y drills
+// another hole, until G80 or another motion code.
+var cycleCodes = map[gcode.Code]bool{"G81": true, "G82": true, "G83": true}
+
+// repeatsCycle reports whether the current line drills another hole with the cycle in effect,
+// without naming it.
+func (c *Cmd) repeatsCycle() bool {
+	return c.cycle != "" && !c.hasCode(c.cycle) && (c.has('X') || c.has('Y'))
+}
+
+// cycleMove moves from the current position to (x,y,z), in a straight line or, for rapids, not.
+func (c *Cmd) cycleMove(x, y, z float64, straight bool) error {
+	c.start = c.pos()
+	if c.start.x == x && c.start.y == y && c.start.z == z {
+		return nil
+	}
+	c.env['X'], c.env['Y'], c.env['Z'] = x, y, z
+	if straight {
+		return c.moveStraight()
+	}
+	return c.move()
+}
+
+// drill drills a hole at X and Y down to Z, or the last Z given, with the cycle in effect. The
+// tool rapids over the hole and down to R, feeds down to Z, and comes back up to R after a G99 or
+// to where it started (or R, if that's higher) after a G98. G82 dwells at the bottom for P
+// milliseconds; G83 pecks its way down Q at a time, coming back up to R after each peck to clear
+// the chips.
+//
+// Only straight Z moves are used below the height the hole started at, so the tool never gets
+// dragged sideways through the work.
+func (c *Cmd) drill() {
+	if c.has('Z') {
+		c.bottom = c.env['Z']
+	}
+	x, y, bottom, r := c.env['X'], c.env['Y'], c.bottom, c.env['R']
+	c.Log(fmt.Sprintf("%s: drill %8.2f %8.2f from %8.2f to %8.2f", c.cycle, x, y, r, bottom))
+	if c.relative {
+		c.Log(" → canned cycles only work with absolute positions (G90)\n")
+		c.m.stop()
+		return
+	}
+	if bottom > r {
+		c.Log(" → the bottom of the hole is above R\n")
+		c.m.stop()
+		return
+	}
+	peck := c.env['Q']
+	if c.inches {
+		peck *= mmPerInch
+	}
+	if c.cycle == "G83" && peck <= 0 {
+		c.Log(" → G83 needs a positive peck depth Q\n")
+		c.m.stop()
+		return
+	}
+
+	// Start from where the line started, rather than where its words put us.
+	c.env['X'], c.env['Y'], c.env['Z'] = c.start.x, c.start.y, c.start.z
+	clear := r
+	if !c.retractR {
+		clear = math.Max(c.start.z, r)
+	}
+
+	if err := c.drillHole(x, y, bottom, r, peck, clear); err != nil {
+		c.Log(fmt.Sprintf(" → %s\n", err))
+		c.m.stop()
+		return
+	}
+	c.Log(" → OK\n")
+}
+
+// drillHole makes the moves for drill, ending up at clear.
+func (c *Cmd) drillHole(x, y, bottom, r, peck, clear float64) error {
+	if c.start.z < r {
+		if err := c.cycleMove(c.start.x, c.start.y, r, true); err != nil {
+			return err
+		}
+	}
+	if err := c.cycleMove(x, y, c.env['Z'], false); err != nil {
+		return err
+	}
+	if err := c.cycleMove(x, y, r, true); err != nil {
+		return err
+	}
+
+	if c.cycle == "G83" {
+		for depth := r - peck; depth > bottom; depth -= peck {
+			if err := c.cycleMove(x, y, depth, true); err != nil {
+				return err
+			}
+			if err := c.cycleMove(x, y, r, true); err != nil {
+				return err
+			}
+			if err := c.cycleMove(x, y, depth+peckClearance, true); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.cycleMove(x, y, bottom, true); err != nil {
+		return err
+	}
+
+	if c.cycle == "G82" {
+		if err := c.m.Break(); err != nil {
+			return err
+		}
+		c.m.dwell(c.env['P'] / 1000)
+	}
+	if err := c.cycleMove(x, y, clear, true); err != nil {
+		return err
+	}
+	return c.m.Break()
+}
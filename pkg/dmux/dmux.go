@@ -0,0 +1,567 @@
+package dmux
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+
+	"github.com/LHSRobotics/gdmux/pkg/gcode"
+	"github.com/LHSRobotics/gdmux/pkg/staubli"
+)
+
+type point struct {
+	x, y, z, a, b, c float64
+}
+
+// mmPerInch converts the lengths of G20 (inch mode) programs to the millimetres the arm expects.
+const mmPerInch = 25.4
+
+// lengthVars are the variables holding lengths, which are scaled when in inch mode. Feed rates are
+// lengths per minute, so they're scaled as well.
+var lengthVars = map[byte]bool{
+	'X': true, 'Y': true, 'Z': true,
+	'I': true, 'J': true, 'K': true,
+	'E': true, 'F': true, 'R': true,
+}
+
+// axisVars are the variables holding coordinates, which are affected by G91 and G92.
+var axisVars = map[byte]bool{'X': true, 'Y': true, 'Z': true}
+
+// rotaryVars are the variables holding the tool's orientation, in degrees. A, B and C are added to
+// the default yaw, pitch and roll, so A0 B0 C0 keeps the orientation of the plain moves. Like the
+// axes, they're increments after a G91.
+var rotaryVars = map[byte]bool{'A': true, 'B': true, 'C': true}
+
+// earlyCodes switch the spindle, coolant and outputs. As in LinuxCNC, they're carried out before
+// anything else on their line, whatever order they're written in, so G1 X10 M3 cuts the whole
+// move with the spindle on.
+var earlyCodes = map[gcode.Code]bool{
+	"M3": true, "M4": true, "M5": true,
+	"M7": true, "M8": true, "M9": true,
+	"M62": true, "M63": true, "M64": true, "M65": true,
+}
+
+// Cmd is the state of a program as it runs: its variables and modes, and the operations queued up
+// for the current line.
+type Cmd struct {
+	// x is the executor running the program, and m the machine it runs on.
+	x *Executor
+	m machine
+	// log reports progress.
+	log func(msg string)
+	// wcs and tools are the work offsets and tools the program sees.
+	wcs   *WorkOffsets
+	tools *ToolTable
+
+	env    map[byte]float64
+	ops    []func(c *Cmd)
+	inches bool
+	line   *gcode.Line
+	// lines is how long the program is, for reporting progress.
+	lines int
+
+	// early is how many of the ops, at the front, are for earlyCodes or a new spindle speed.
+	early int
+
+	// relative is set by G91, after which axis words are increments rather than positions.
+	relative bool
+	// arcAbsolute is set by G90.1, after which I, J and K are positions rather than offsets from
+	// the start of the arc.
+	arcAbsolute bool
+	// setting is true when the current line has a G92 or G10, whose axis words are always
+	// positions.
+	setting bool
+	// rotary is set once the program uses A, B or C, after which moves set the orientation of
+	// the tool as well as its position.
+	rotary bool
+	// length is the tool length applied by G43, and cleared by G49.
+	length float64
+	// spindleOn is set between M3 or M4 and M5.
+	spindleOn bool
+	// synced holds the output changes from M62 and M63, which happen when the next move starts.
+	synced []func(c *Cmd)
+	// input is the result of the last M66: 1 or 0 for the input's state, -1 for a timeout.
+	input float64
+	// probed is where the last G38.2 touched, in program coordinates.
+	probed point
+	// at is where the last move left the arm, in program coordinates.
+	at point
+	// penDown is set while the plotter's pen is down.
+	penDown bool
+
+	// eRelative is set by M83, after which E is an increment rather than a position.
+	eRelative bool
+	// eStart is E at the start of the current line.
+	eStart float64
+	// extruding is set while the extruder is catching up with a move.
+	extruding bool
+
+	// cycle is the canned cycle in effect, from G81, G82 or G83 until G80.
+	cycle gcode.Code
+	// bottom is the Z the canned cycle drills down to, which carries over to lines without a Z.
+	bottom float64
+	// retractR is set by G99, after which canned cycles come back up to R rather than to where
+	// they started.
+	retractR bool
+
+	// comp is the side cutter radius compensation puts the tool on, G41 for the left or G42 for
+	// the right, or empty after G40.
+	comp gcode.Code
+	// pending is the last compensated move, which waits to see where the next one goes.
+	pending *segment
+
+	// done is set by M2 and M30, which end the program.
+	done bool
+
+	// start is the position at the start of the current line, in program coordinates.
+	start point
+	// offset is added to program coordinates to get back to the origin's, as set by G92.
+	offset point
+}
+
+// pos returns the current position and orientation in program coordinates.
+func (c *Cmd) pos() point {
+	return point{
+		x: c.env['X'], y: c.env['Y'], z: c.env['Z'],
+		a: c.env['A'], b: c.env['B'], c: c.env['C'],
+	}
+}
+
+// hasCode reports whether the current line has the given code.
+func (c *Cmd) hasCode(code gcode.Code) bool {
+	for _, cc := range c.line.Codes {
+		if cc == code {
+			return true
+		}
+	}
+	return false
+}
+
+// sync makes the output changes waiting for the next move.
+func (c *Cmd) sync() {
+	for _, f := range c.synced {
+		f(c)
+	}
+	c.synced = c.synced[:0]
+}
+
+// has reports whether the current line sets the variable v.
+func (c *Cmd) has(v byte) bool {
+	for _, code := range c.line.Codes {
+		if code[0] == v {
+			return true
+		}
+	}
+	return false
+}
+
+// toArm returns the arm coordinates of p, a point in program coordinates. This is where the G92
+// offset, the height map, the work offsets and the work plane all come together.
+//
+// The orientation is turned into the yaw, pitch and roll the arm expects, in a, b and c.
+func (c *Cmd) toArm(p point) point {
+	p = p.add(c.offset)
+	if c.x.plotter != nil {
+		p.z = c.penHeight()
+	}
+	if c.x.mesh != nil {
+		p.z += c.x.mesh.at(p.x, p.y)
+	}
+	q := c.wcs.toArm(p)
+	q.a = p.a + staubli.DefaultYaw
+	q.b = p.b + staubli.DefaultPitch
+	q.c = p.c + staubli.DefaultRoll
+	return q
+}
+
+// pose converts an arm position, as returned by toArm, into a staubli.Pose.
+func (p point) pose() staubli.Pose {
+	return staubli.Pose{X: p.x, Y: p.y, Z: p.z, Yaw: p.a, Pitch: p.b, Roll: p.c}
+}
+
+// flange returns the pose the flange has to be in for the mounted tool's tip to be in pose p.
+func (c *Cmd) flange(p staubli.Pose) staubli.Pose {
+	return p.Flange(c.tools.tcp(c.length))
+}
+
+// sixDOF reports whether the moves need to set the orientation as well as the position, because
+// the program uses A, B or C, or because the mounted tool is turned.
+func (c *Cmd) sixDOF() bool {
+	if c.rotary {
+		return true
+	}
+	t := c.tools.Mounted()
+	return t != nil && t.turned()
+}
+
+// target returns the arm coordinates of the flange for the current position.
+func (c *Cmd) target() (x, y, z float64) {
+	p := c.flange(c.toArm(c.pos()).pose())
+	return p.X, p.Y, p.Z
+}
+
+// move moves the arm to the current position, without guaranteeing a straight line.
+//
+// When plotting, the pen is lifted for the move, and put back down afterwards if it should be.
+func (c *Cmd) move() error {
+	c.sync()
+	down, err := c.plotRapid()
+	if err != nil {
+		return err
+	}
+
+	p := c.flange(c.toArm(c.pos()).pose())
+	if c.sixDOF() {
+		err = c.m.Move6DOF(p.X, p.Y, p.Z, p.Yaw, p.Pitch, p.Roll)
+	} else {
+		err = c.m.Move(p.X, p.Y, p.Z)
+	}
+	if err != nil {
+		return err
+	}
+	c.at = c.pos()
+
+	if down {
+		return c.pen(true)
+	}
+	return nil
+}
+
+// moveStraight moves the arm in a straight line from the start of the line to the current
+// position. With a height map, long moves are split up so the height follows the surface along
+// the way and not just at the ends.
+//
+// When the orientation changes, the move is split up too, every AngleStep degrees, and the tool
+// turns smoothly between the two orientations. Left to itself, the controller interpolates the
+// Euler angles, which can flip the wrist around in surprising ways.
+func (c *Cmd) moveStraight() error {
+	c.sync()
+	if err := c.plotStraight(); err != nil {
+		return err
+	}
+	if err := c.startExtrusion(); err != nil {
+		return err
+	}
+	end := c.pos()
+	if c.x.plotter != nil && c.toArm(end) == c.toArm(c.at) {
+		// Nothing left to do after moving the pen.
+		return nil
+	}
+	n := c.x.mesh.segments(c.start, end, c.x.meshStep)
+
+	from, to := c.toArm(c.start).pose(), c.toArm(end).pose()
+	if c.sixDOF() {
+		if c.x.angleStep > 0 {
+			a := from.Quaternion().Angle(to.Quaternion())
+			if m := int(math.Ceil(a / c.x.angleStep)); m > n {
+				n = m
+			}
+		}
+	}
+
+	for i := 1; i <= n; i++ {
+		t := float64(i) / float64(n)
+		// The position comes from toArm rather than Interpolate, so it follows the height map.
+		p := c.toArm(c.start.add(end.sub(c.start).scale(t))).pose()
+		o := staubli.Interpolate(from, to, t)
+		p.Yaw, p.Pitch, p.Roll = o.Yaw, o.Pitch, o.Roll
+		p = c.flange(p)
+
+		var err error
+		if c.sixDOF() {
+			err = c.m.MoveStraight6DOF(p.X, p.Y, p.Z, p.Yaw, p.Pitch, p.Roll)
+		} else {
+			err = c.m.MoveStraight(p.X, p.Y, p.Z)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	c.at = end
+	return nil
+}
+
+// arc moves the arm along an arc to the current position, around the centre given by I, J and K,
+// going in the given direction.
+func (c *Cmd) arc(direction float64) error {
+	if c.tilted() {
+		return fmt.Errorf("arcs only work in the default orientation")
+	}
+	c.sync()
+	if err := c.plotStraight(); err != nil {
+		return err
+	}
+
+	if err := c.startExtrusion(); err != nil {
+		return err
+	}
+
+	x, y, z := c.target()
+	i, j, k := c.centre()
+	if err := c.m.ArcCenter(x, y, z, i, j, k, direction); err != nil {
+		return err
+	}
+	c.at = c.pos()
+	return c.finishExtrusion()
+}
+
+// tilted reports whether the tool has been turned away from its default orientation, by A, B or C
+// or by the way it's mounted.
+func (c *Cmd) tilted() bool {
+	if c.env['A'] != 0 || c.env['B'] != 0 || c.env['C'] != 0 {
+		return true
+	}
+	t := c.tools.Mounted()
+	return t != nil && t.turned()
+}
+
+// describe formats the current position for the log.
+func (c *Cmd) describe() string {
+	s := fmt.Sprintf("%8.2f %8.2f %8.2f", c.env['X'], c.env['Y'], c.env['Z'])
+	if c.rotary {
+		s += fmt.Sprintf(" A%.2f B%.2f C%.2f", c.env['A'], c.env['B'], c.env['C'])
+	}
+	return s
+}
+
+// centre returns the centre of the arc on the current line, relative to the start of the arc.
+//
+// The offset is turned to follow the work plane, but the arm still draws the arc flat and only
+// moves along z linearly, so arcs on a tilted plane are a bit off.
+func (c *Cmd) centre() (i, j, k float64) {
+	p := point{x: c.env['I'], y: c.env['J'], z: c.env['K']}
+	if c.arcAbsolute {
+		p = p.sub(c.start)
+	}
+	p = c.wcs.Plane().apply(p)
+	return p.x, p.y, p.z
+}
+
+func (c *Cmd) Exec() {
+	if c.x.verbose {
+		log.Printf("executing line %v", c.line)
+	}
+
+	for _, op := range c.ops {
+		op(c)
+	}
+}
+
+// SetVar parses a variable-setting code, such as X, Y, or E.
+func (c *Cmd) SetVar(code gcode.Code) error {
+	value, err := strconv.ParseFloat(string(code[1:]), 32)
+	if err != nil {
+		return fmt.Errorf("bad value %s", code)
+	}
+
+	if c.inches && lengthVars[code[0]] {
+		value *= mmPerInch
+	}
+	if c.relative && !c.setting && (axisVars[code[0]] || rotaryVars[code[0]]) {
+		value += c.env[code[0]]
+	}
+	if c.eRelative && !c.setting && code[0] == 'E' {
+		value += c.env['E']
+	}
+	if rotaryVars[code[0]] {
+		c.rotary = true
+	}
+	c.env[code[0]] = value
+	return nil
+}
+
+// SetModes looks for codes on the current line that change how its variables are read, such as
+// G20/G21 for the units or G90/G91 for the positioning mode, and switches modes accordingly.
+//
+// This has to happen before any of the line's variables are set, since the modes apply to the
+// whole line regardless of where the code appears in it.
+func (c *Cmd) SetModes() {
+	c.start = c.pos()
+	c.eStart = c.env['E']
+	c.setting = false
+	for _, code := range c.line.Codes {
+		switch code {
+		case "G20":
+			c.inches = true
+		case "G21":
+			c.inches = false
+		case "G90":
+			c.relative = false
+		case "G91":
+			c.relative = true
+		case "G90.1":
+			c.arcAbsolute = true
+		case "G91.1":
+			c.arcAbsolute = false
+		case "M82":
+			c.eRelative = false
+		case "M83":
+			c.eRelative = true
+		case "G92", "G10":
+			c.setting = true
+		case "G40":
+			c.comp = ""
+		case "G41", "G42":
+			c.comp = code
+		case "G98":
+			c.retractR = false
+		case "G99":
+			c.retractR = true
+		case "G81", "G82", "G83":
+			c.cycle = code
+		case "G80", "G0", "G1", "G2", "G3", "G38.2":
+			c.cycle = ""
+		}
+	}
+}
+
+// queue adds op to the operation queue, after the other early ones if it's early, and at the end
+// otherwise.
+func (c *Cmd) queue(early bool, op func(c *Cmd)) {
+	if !early {
+		c.ops = append(c.ops, op)
+		return
+	}
+	c.ops = append(c.ops, nil)
+	copy(c.ops[c.early+1:], c.ops[c.early:])
+	c.ops[c.early] = op
+	c.early++
+}
+
+// AddOp parses and adds an G- or M-code to the operation queue.
+func (c *Cmd) AddOp(code gcode.Code) {
+	early := earlyCodes[code]
+	if !c.x.custom[code] {
+		if c.x.plotter != nil {
+			if down, ok := c.x.plotter.penCode(code); ok {
+				c.queue(early, func(c *Cmd) {
+					if err := c.pen(down); err != nil {
+						c.Log(fmt.Sprintf("%s → %s\n", code, err))
+					}
+				})
+				return
+			}
+		}
+
+		if c.comp != "" && compCodes[code] {
+			c.queue(false, func(c *Cmd) {
+				c.compensate(code)
+			})
+			return
+		}
+	}
+
+	h, ok := c.x.handlers[code]
+	if !ok {
+		log.Printf("unknown code: %v", code) // should return an error here instead
+		return
+	}
+	if h != nil {
+		c.queue(early, func(c *Cmd) {
+			h(c, code)
+		})
+	}
+}
+
+// Run executes the program read from r, returning once it ends or is stopped.
+func (e *Executor) Run(r io.Reader) error {
+	return e.RunFrom(r, 0)
+}
+
+// run runs the program read from r through cmd.
+func (e *Executor) run(cmd *Cmd, r io.Reader) error {
+	p, err := gcode.NewProgram(r)
+	if err != nil {
+		return fmt.Errorf("error reading program: %v", err)
+	}
+	cmd.x = e
+	cmd.env = make(map[byte]float64)
+	n := 1
+	for {
+		l, err := p.Next()
+		if err == io.EOF {
+			if cmd.pending != nil && cmd.m.running() {
+				if err := cmd.flush(); err != nil {
+					cmd.Log(fmt.Sprintf("Compensation → %s\n", err))
+				}
+			}
+			cmd.m.progress(p.Len(), p.Len())
+			break
+		} else if err != nil {
+			// TODO probably better to pause on errors
+			return fmt.Errorf("parse error: %v", err)
+		}
+		cmd.line = l
+
+		cmd.SetModes()
+		for _, c := range cmd.line.Codes {
+			switch c[0] {
+			case 'G', 'M':
+				cmd.AddOp(c)
+			case 'X', 'Y', 'Z', 'A', 'B', 'C', 'E', 'F', 'H', 'I', 'J', 'K', 'L', 'P', 'Q', 'R', 'T', 'D':
+				if err := cmd.SetVar(c); err != nil {
+					return fmt.Errorf("line %d: %v", l.Number, err)
+				}
+			case 'S':
+				// On a G4, S is how long to dwell for, not the spindle speed.
+				if cmd.hasCode("G4") {
+					break
+				}
+				if err := cmd.SetVar(c); err != nil {
+					return fmt.Errorf("line %d: %v", l.Number, err)
+				}
+				// A new speed on its own changes the power of a running spindle.
+				if !cmd.hasCode("M3") && !cmd.hasCode("M4") {
+					cmd.queue(true, func(c *Cmd) {
+						if c.spindleOn {
+							c.power("S")
+						}
+					})
+				}
+			default:
+				log.Printf("unknown code class: %v (%v)", c, cmd.line)
+			}
+		}
+		if cmd.repeatsCycle() {
+			cmd.AddOp(cmd.cycle)
+		}
+		// TODO handle pausing as well
+		if !cmd.m.running() {
+			return nil
+		}
+		if rp, ok := cmd.m.(*replay); ok && l.Number >= rp.from {
+			if err := rp.resume(); err != nil {
+				return fmt.Errorf("resuming at line %d: %v", l.Number, err)
+			}
+			cmd.m, cmd.log, cmd.wcs, cmd.tools = rp.live, e.log, e.wcs, e.tools
+		}
+		cmd.lines = p.Len()
+		cmd.m.progress(l.Number, cmd.lines)
+		if cmd.pending != nil && !cmd.compensating() {
+			if err := cmd.flush(); err != nil {
+				cmd.Log(fmt.Sprintf("Compensation → %s\n", err))
+				return nil
+			}
+			cmd.m.progress(l.Number, cmd.lines)
+		}
+		cmd.Exec()
+		// Making a compensated move from an earlier line reports that line, so get back to this
+		// one.
+		cmd.m.progress(l.Number, cmd.lines)
+		cmd.ops, cmd.early = cmd.ops[:0], 0
+		if cmd.done {
+			cmd.Log("End of program\n")
+			break
+		}
+
+		// Pass what the machine found out back to the program, in LinuxCNC's parameters.
+		p.SetParam(5399, cmd.input)
+		p.SetParam(5061, cmd.probed.x)
+		p.SetParam(5062, cmd.probed.y)
+		p.SetParam(5063, cmd.probed.z)
+		n++
+	}
+	return nil
+}
@@ -0,0 +1,726 @@
+package dmux
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/LHSRobotics/gdmux/pkg/extruder"
+	"github.com/LHSRobotics/gdmux/pkg/gcode"
+	"github.com/LHSRobotics/gdmux/pkg/staubli"
+)
+
+// moves returns the calls the recorder got, apart from the breaks between them.
+func moves(rec *staubli.Recorder) []string {
+	var calls []string
+	for _, c := range rec.Calls {
+		if c.Name != "break" {
+			calls = append(calls, c.String())
+		}
+	}
+	return calls
+}
+
+// run runs the gcode in r through an executor with the given options, and checks the calls that
+// reach the arm.
+func run(t *testing.T, opts Options, r io.Reader, want []string) *Executor {
+	return runOn(t, &staubli.Recorder{}, opts, r, want)
+}
+
+// runOn is run with a recorder that's been given a script.
+func runOn(t *testing.T, rec *staubli.Recorder, opts Options, r io.Reader, want []string) *Executor {
+	e := New(rec, opts)
+	if err := e.Run(r); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := moves(rec)
+	if len(calls) != len(want) {
+		t.Fatalf("got %d arm calls, want %d: %q", len(calls), len(want), calls)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Errorf("call %d: got %q, want %q", i, calls[i], want[i])
+		}
+	}
+	return e
+}
+
+func TestInches(t *testing.T) {
+	f, err := os.Open("../../pkg/gcode/samples/square_inch.gcode")
+	if err != nil {
+		t.Fatalf("couldn't open test input: %v", err)
+	}
+	defer f.Close()
+
+	run(t, Options{}, f, []string{
+		"line 0.00 0.00 25.40",
+		"line 50.80 0.00 25.40",
+		"arc 50.80 101.60 25.40 0.00 50.80 0.00 -1.00",
+		"arc 50.80 0.00 12.70 0.00 -50.80 0.00 1.00",
+		"move 50.80 -25.40 12.70",
+	})
+}
+
+func TestPositioning(t *testing.T) {
+	prog := `G1 X10 Y10 Z10
+G91 G1 X5 Z-5
+G92 X0 Y0
+G1 X1 Y1
+G90 G1 X2 Y2
+G90.1 G2 X4 Y2 I3 J2 K5
+G92.1
+G1 X20
+`
+	run(t, Options{}, strings.NewReader(prog), []string{
+		"line 10.00 10.00 10.00",
+		"line 15.00 10.00 5.00",
+		"line 16.00 11.00 5.00",
+		"line 17.00 12.00 5.00",
+		"arc 19.00 12.00 5.00 1.00 0.00 0.00 -1.00",
+		"line 20.00 12.00 5.00",
+	})
+}
+
+func TestWorkOffsets(t *testing.T) {
+	prog := `G1 X1 Y1 Z1
+G10 L2 P2 X100 Y0 Z50
+G1 X2
+G55 G1 X3
+G10 L20 P0 X0 Y0
+G1 X1 Y1
+G54 G1 X0 Y0
+`
+	run(t, Options{}, strings.NewReader(prog), []string{
+		"line 1.00 1.00 1.00",
+		"line 2.00 1.00 1.00",
+		"line 103.00 1.00 51.00",
+		"line 104.00 2.00 51.00",
+		"line 0.00 0.00 1.00",
+	})
+
+	// L20 for a system that isn't active only changes the axes on the line, and the G92 offset
+	// still applies to what the position should read as.
+	prog = `G10 L2 P2 X100 Y0 Z50
+G1 X1 Y1 Z1
+G10 L20 P2 X0
+G55 G1 X0 Y0 Z0
+G54 G1 X5 Y0 Z0
+G92 X0
+G10 L20 P3 X0 Y0 Z0
+G56 G1 X0
+`
+	run(t, Options{}, strings.NewReader(prog), []string{
+		"line 1.00 1.00 1.00",
+		"line 1.00 0.00 50.00",
+		"line 5.00 0.00 0.00",
+		"line 5.00 0.00 0.00",
+	})
+}
+
+func TestPlane(t *testing.T) {
+	// A table tilted 45° about the y axis, zeroed at (100, 0, 0).
+	f, err := PlaneFrame([3]float64{100, 0, 0}, [3]float64{110, 0, 10}, [3]float64{100, 10, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWorkOffsets([3]float64{})
+	w.SetPlane([3]float64{100, 0, 0}, f)
+
+	rec := &staubli.Recorder{}
+	if err := New(rec, Options{WCS: w}).Run(strings.NewReader("G1 X10 Y5\nG1 Z10\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := 10 / math.Sqrt2
+	want := []string{
+		fmt.Sprintf("line %.2f 5.00 %.2f", 100+s, s),
+		fmt.Sprintf("line 100.00 5.00 %.2f", 2*s),
+	}
+	if got := moves(rec); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHeightMap(t *testing.T) {
+	m, err := readHeightCSV(strings.NewReader(`# x, y, z
+0, 0, 0
+10, 0, 1
+0, 10, 2
+10, 10, 3
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, Options{HeightMap: m, MeshStep: 5}, strings.NewReader("G1 X0 Y0 Z0\nG1 X10 Y10\nG0 X20 Y5 Z1\n"), []string{
+		"line 0.00 0.00 0.00",
+		"line 3.33 3.33 1.00",
+		"line 6.67 6.67 2.00",
+		"line 10.00 10.00 3.00",
+		"move 20.00 5.00 3.00",
+	})
+
+	if _, err := readHeightCSV(strings.NewReader("0,0,0\n1,0,0\n10,0,0\n0,10,0\n1,10,0\n10,10,0\n")); err == nil {
+		t.Errorf("read a height map with uneven spacing")
+	}
+}
+
+func TestRotary(t *testing.T) {
+	prog := `G1 X10
+G1 Y10 A10
+G91 G0 B-15 C5
+G90 G2 X10 Y0 J-5
+`
+	run(t, Options{AngleStep: 5}, strings.NewReader(prog), []string{
+		"line 10.00 0.00 0.00",
+		"line6 10.00 5.00 0.00 5.00 90.00 180.00",
+		"line6 10.00 10.00 0.00 10.00 90.00 180.00",
+		"move6 10.00 10.00 0.00 10.00 75.00 185.00",
+	})
+}
+
+func TestTools(t *testing.T) {
+	tools := &ToolTable{tools: map[int]*Tool{
+		1: {ID: 1, Name: "pen", Offset: [3]float64{0, 5, 100}},
+	}}
+
+	// In the default orientation the flange's z axis points along the arm's x axis, and its y
+	// axis along the arm's -y.
+	run(t, Options{Tools: tools}, strings.NewReader("G1 X10\nT1 M6\nG1 X20\nG43 G1 X30\nG49 G1 X40\n"), []string{
+		"line 10.00 0.00 0.00",
+		"line 20.00 5.00 0.00",
+		"line -70.00 5.00 0.00",
+		"line 40.00 5.00 0.00",
+	})
+}
+
+func TestCompensation(t *testing.T) {
+	tools := &ToolTable{tools: map[int]*Tool{1: {ID: 1, Name: "marker", Diameter: 2}}}
+
+	// With the tool on the left, the left turn at 10,0 is on the inside of the corner and the
+	// right turn at 10,10 is on the outside, where the tool goes round on an arc. The arc after
+	// that carries straight on, and is offset towards its centre.
+	prog := `G41 D1 G1 X10
+G1 Y10
+G1 X20
+G3 X30 Y20 I0 J10
+G40 G1 X30 Y0
+`
+	run(t, Options{Tools: tools}, strings.NewReader(prog), []string{
+		"line 9.00 1.00 0.00",
+		"line 9.00 10.00 0.00",
+		"arc 10.00 11.00 0.00 1.00 0.00 0.00 -1.00",
+		"line 20.00 11.00 0.00",
+		"arc 29.00 20.00 0.00 0.00 9.00 0.00 1.00",
+		"line 30.00 0.00 0.00",
+	})
+
+	// Each move waits for the next line, but it's reported against its own line when it's made,
+	// with the arc round the corner as part of the line before it.
+	var got []string
+	e := New(&staubli.Recorder{}, Options{Tools: tools, Log: func(string) {}, Events: func(ev Event) {
+		switch ev.Type {
+		case EventProgress:
+			got = append(got, fmt.Sprintf("%d", ev.Line))
+		case EventMove:
+			got = append(got, string(ev.Op))
+		}
+	}})
+	if err := e.Run(strings.NewReader(prog)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1", "2", "1", "line", "2", "3", "2", "line", "arc", "3", "4", "3", "line", "4", "5", "4", "arc", "5", "line"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got progress %q, want %q", got, want)
+	}
+
+	p, err := New(&staubli.Recorder{}, Options{Tools: tools, Log: func(string) {}}).Plan(strings.NewReader(prog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, s := range p.Steps {
+		if s.Op != OpBreak {
+			got = append(got, fmt.Sprintf("%d %s", s.Line, s.Op))
+		}
+	}
+	want = []string{"1 line", "2 line", "2 arc", "3 line", "4 arc", "5 line"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got plan steps %q, want %q", got, want)
+	}
+}
+
+func TestSignals(t *testing.T) {
+	signals := &SignalConfig{Spindle: 1, SpindleCCW: 2, SpindleAnalog: 1, SpindleMax: 1000, SpindleVolts: 10, Outputs: []int{7}}
+
+	run(t, Options{Signals: signals}, strings.NewReader("M3 S500\nS250\nM62 P0\nG1 X1\nM5\n"), []string{
+		"analog 1.00 5.00",
+		"signal 2.00 0.00",
+		"signal 1.00 1.00",
+		"analog 1.00 2.50",
+		"signal 7.00 1.00",
+		"line 1.00 0.00 0.00",
+		"signal 2.00 0.00",
+		"signal 1.00 0.00",
+	})
+
+	// The spindle and outputs are switched before the move on their line, wherever they are on it.
+	run(t, Options{Signals: signals}, strings.NewReader("G1 X10 M3 S500 M62 P0\n"), []string{
+		"analog 1.00 5.00",
+		"signal 2.00 0.00",
+		"signal 1.00 1.00",
+		"signal 7.00 1.00",
+		"line 10.00 0.00 0.00",
+	})
+
+	// Without a signal for it, M4 stops the program rather than run the spindle clockwise.
+	run(t, Options{Log: func(string) {}, Signals: &SignalConfig{Spindle: 1, SpindleAnalog: 1, SpindleMax: 1000, SpindleVolts: 10}},
+		strings.NewReader("M4 S500\nG1 X10\n"), nil)
+}
+
+func TestProbe(t *testing.T) {
+	signals := &SignalConfig{SpindleMax: 1000, SpindleVolts: 10, Inputs: []int{3}, Probe: 4}
+
+	// The probe touches halfway there.
+	rec := &staubli.Recorder{Touches: [][3]float64{{0, 0, -5}}}
+	runOn(t, rec, Options{Signals: signals}, strings.NewReader("M66 P0 L3 Q1\nG38.2 Z-10\nG1 X1\n"), []string{
+		"input 3.00",
+		"probe 0.00 0.00 -10.00 4.00",
+		"line 1.00 0.00 -5.00",
+	})
+}
+
+func TestPark(t *testing.T) {
+	park := &ParkConfig{SafeZ: 50, G30: &[3]float64{300, 100, 200}}
+
+	// G4 P is in milliseconds, and its S doesn't touch the spindle speed.
+	run(t, Options{Park: park}, strings.NewReader("S100\nG1 X10\nG4 P1 S0.001\nG28\nG1 Z60\nG30 X20\n"), []string{
+		"line 10.00 0.00 0.00",
+		"line 10.00 0.00 50.00",
+		"ready",
+		"line 10.00 0.00 60.00",
+		"move 20.00 0.00 60.00",
+		"move 300.00 100.00 200.00",
+	})
+}
+
+func TestCycles(t *testing.T) {
+	// A G81 from Z10 with a G98 retract, repeated at X20, then a G83 pecking 2 at a time that
+	// comes back to R after a G99.
+	prog := `G0 Z10
+G98 G81 X10 Y0 Z-3 R2
+X20
+G99 G83 X30 Z-5 R2 Q3
+G80 G0 Z10
+`
+	run(t, Options{}, strings.NewReader(prog), []string{
+		"move 0.00 0.00 10.00",
+		"move 10.00 0.00 10.00",
+		"line 10.00 0.00 2.00",
+		"line 10.00 0.00 -3.00",
+		"line 10.00 0.00 10.00",
+		"move 20.00 0.00 10.00",
+		"line 20.00 0.00 2.00",
+		"line 20.00 0.00 -3.00",
+		"line 20.00 0.00 10.00",
+		"move 30.00 0.00 10.00",
+		"line 30.00 0.00 2.00",
+		"line 30.00 0.00 -1.00",
+		"line 30.00 0.00 2.00",
+		"line 30.00 0.00 -0.75",
+		"line 30.00 0.00 -4.00",
+		"line 30.00 0.00 2.00",
+		"line 30.00 0.00 -3.75",
+		"line 30.00 0.00 -5.00",
+		"line 30.00 0.00 2.00",
+		"move 30.00 0.00 10.00",
+	})
+}
+
+func TestStops(t *testing.T) {
+	opts := Options{
+		Signals: &SignalConfig{Spindle: 1, SpindleMax: 1000, SpindleVolts: 10},
+		Console: strings.NewReader("\n"),
+	}
+
+	// M1 is skipped with optional stops off, M0 waits for a line on the console, and M30 turns
+	// the spindle off and ends the program there.
+	e := run(t, opts, strings.NewReader("M3\nG1 X1\nM1\nM0\nG1 X2\nM117 Swap pens\nM30\nG1 X3\n"), []string{
+		"signal 1.00 1.00",
+		"line 1.00 0.00 0.00",
+		"line 2.00 0.00 0.00",
+		"signal 1.00 0.00",
+	})
+	if msg := e.Message(); msg != "Swap pens" {
+		t.Errorf("got message %q, want %q", msg, "Swap pens")
+	}
+}
+
+func TestControl(t *testing.T) {
+	signals := &SignalConfig{SpindleMax: 1000, SpindleVolts: 10, Inputs: []int{3}}
+
+	// The loop runs in the program, and the M66 result comes back in #5399.
+	prog := `o1 repeat [2]
+  G91 G1 X5
+o1 endrepeat
+M66 P0 L3
+o2 if [#5399 EQ 1]
+  G90 G1 Y[#5399 * 5]
+o2 endif
+`
+	run(t, Options{Signals: signals}, strings.NewReader(prog), []string{
+		"line 5.00 0.00 0.00",
+		"line 10.00 0.00 0.00",
+		"input 3.00",
+		"line 10.00 5.00 0.00",
+	})
+}
+
+func TestPlotter(t *testing.T) {
+	plotter := &PlotterConfig{Pen: "z", UpZ: 5, DownZ: -1}
+
+	prog := `G0 X0 Y0 Z2
+G1 Z-0.5
+G1 X10
+G0 X20
+G1 Z3
+`
+	run(t, Options{Plotter: plotter}, strings.NewReader(prog), []string{
+		"move 0.00 0.00 5.00",
+		"line 0.00 0.00 -1.00",
+		"line 10.00 0.00 -1.00",
+		"line 10.00 0.00 5.00",
+		"move 20.00 0.00 5.00",
+		"line 20.00 0.00 -1.00",
+		"line 20.00 0.00 5.00",
+	})
+}
+
+// okController records the lines sent to it and acknowledges every one of them.
+type okController struct {
+	sent    []string
+	replies bytes.Buffer
+}
+
+func (o *okController) Write(b []byte) (int, error) {
+	o.sent = append(o.sent, strings.TrimSpace(string(b)))
+	o.replies.WriteString("ok\n")
+	return len(b), nil
+}
+
+func (o *okController) Read(b []byte) (int, error) {
+	return o.replies.Read(b)
+}
+
+func TestExtruder(t *testing.T) {
+	ctl := &okController{}
+	ext := extruder.NewExtruder(ctl)
+
+	prog := `G21
+M82
+G92 E0
+G1 X10 E1 F600
+G1 E0.5 F1800
+M83
+G1 X20 E2 F600
+`
+	run(t, Options{Extruder: ext}, strings.NewReader(prog), []string{
+		"line 10.00 0.00 0.00",
+		"line 10.00 0.00 0.00",
+		"line 20.00 0.00 0.00",
+	})
+
+	want := []string{
+		"M83",
+		"G1 E1.00000 F60.0",
+		"M400",
+		"G1 E-0.50000 F1800.0",
+		"M400",
+		"G1 E2.00000 F120.0",
+		"M400",
+	}
+	if fmt.Sprint(ctl.sent) != fmt.Sprint(want) {
+		t.Errorf("extruder got %q, want %q", ctl.sent, want)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	// M3 is overridden, even though the plotter would take it for a pen code, and M100 is new.
+	var got []string
+	e := New(&staubli.Recorder{}, Options{Plotter: &PlotterConfig{Pen: "mcode", UpZ: 5, DownZ: -1}})
+	e.Handle("M3", func(c *Cmd, code gcode.Code) {
+		got = append(got, fmt.Sprintf("%s S%v", code, c.Var('S')))
+	})
+	e.Handle("M100", func(c *Cmd, code gcode.Code) {
+		got = append(got, fmt.Sprintf("%s P%v %v", code, c.Var('P'), c.Has('Q')))
+	})
+	if err := e.Run(strings.NewReader("M3 S200\nM100 P2\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"M3 S200", "M100 P2 false"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	tools := &ToolTable{tools: map[int]*Tool{1: {ID: 1, Name: "pen"}}}
+	opts := Options{
+		Signals: &SignalConfig{Spindle: 1, SpindleMax: 1000, SpindleVolts: 10, Inputs: []int{3}},
+		Tools:   tools,
+	}
+	prog := `M3
+G1 X10
+M66 P0 L3 Q1
+o1 if [#5399 EQ 1]
+  G4 P50
+o1 endif
+M1
+M117 Done
+G10 L2 P1 X5
+T1 M6
+`
+	e := New(&staubli.Recorder{}, opts)
+	p, err := e.Plan(strings.NewReader(prog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range p.Steps {
+		got = append(got, s.String())
+	}
+	want := []string{
+		`1: signal 1 1`,
+		`2: line 10 0 0`,
+		`2: break`,
+		`3: wait 3 3 1 1`,
+		`5: dwell 0.05`,
+		`7: pause "M1"`,
+		`8: message "Done"`,
+		`9: zero 0 5 0 0`,
+		`10: tool 1`,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got plan %q, want %q", got, want)
+	}
+	// Planning leaves the offsets and tools alone.
+	if z := e.wcs.Get(0); z != [3]float64{} || tools.Mounted() != nil {
+		t.Errorf("planning changed the settings: zero %v, tool %v", z, tools.Mounted())
+	}
+
+	// The plan survives being saved, and runs the same as the program.
+	var b bytes.Buffer
+	if err := p.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	p, err = ReadPlan(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &staubli.Recorder{}
+	e = New(rec, opts)
+	if err := e.RunPlan(p); err != nil {
+		t.Fatal(err)
+	}
+	direct := run(t, Options{Signals: opts.Signals, Tools: NewToolTable()}, strings.NewReader(prog), moves(rec))
+	if direct.wcs.Get(0) != e.wcs.Get(0) {
+		t.Errorf("plan set zero %v, program set %v", e.wcs.Get(0), direct.wcs.Get(0))
+	}
+	if tools.Mounted() == nil {
+		t.Errorf("running the plan didn't mount the tool")
+	}
+
+	bad := &Plan{Steps: []Step{{Line: 1, Op: OpLine, Args: []float64{1, 2}}}}
+	if err := bad.Validate(); err == nil {
+		t.Errorf("a line with two arguments passed validation")
+	}
+
+	// A program that never ends stops being planned at the limit.
+	e = New(&staubli.Recorder{}, Options{PlanLimit: 100})
+	if _, err := e.Plan(strings.NewReader("o1 while [1]\nG1 X1\no1 endwhile\n")); err != ErrTooLong {
+		t.Errorf("planning an endless program gave %v, want %v", err, ErrTooLong)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	rec := &staubli.Recorder{}
+	e := New(rec, Options{})
+	if p := e.Progress(); !p.Located.IsZero() {
+		t.Errorf("position known before the arm was asked: %+v", p)
+	}
+	if err := e.Run(strings.NewReader("G1 X1\nG1 X5 Y2\n; done\n")); err != nil {
+		t.Fatal(err)
+	}
+	p := e.Progress()
+	if p.Running || p.Line != 3 || p.Lines != 3 || p.Started.IsZero() {
+		t.Errorf("got progress %+v, want 3 of 3 lines done", p)
+	}
+	if want := [3]float64{5, 2, 0}; p.Position != want || p.Located.IsZero() {
+		t.Errorf("got position %v, want %v", p.Position, want)
+	}
+
+	// Planning doesn't count.
+	if _, err := e.Plan(strings.NewReader("G1 X9\n")); err != nil {
+		t.Fatal(err)
+	}
+	if q := e.Progress(); q != p {
+		t.Errorf("planning changed the progress to %+v", q)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	var got []string
+	rec := &staubli.Recorder{Errors: map[string]error{"move": errors.New("out of reach")}}
+	e := New(rec, Options{Log: func(string) {}, Events: func(ev Event) {
+		s := ev.Type
+		switch ev.Type {
+		case EventMove, EventError:
+			s += fmt.Sprintf(" %s %v %s", ev.Op, ev.Args, ev.Text)
+		case EventMoved:
+			s += fmt.Sprintf(" %v", *ev.Position)
+		case EventState:
+			s += " " + ev.State + " " + ev.Text
+		case EventProgress:
+			s += fmt.Sprintf(" %d/%d", ev.Line, ev.Lines)
+		}
+		got = append(got, strings.TrimSpace(s))
+	}})
+	if err := e.Run(strings.NewReader("G1 X1 Y2\nG0 X5\n")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"state running",
+		"progress 1/2",
+		"move line [1 2 0]",
+		"moved [1 2 0]",
+		"progress 2/2",
+		"move move [5 2 0]",
+		"error move [] out of reach",
+		"state idle",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got events %q, want %q", got, want)
+	}
+
+	got = nil
+	if err := e.Run(strings.NewReader("G1 X\n")); err == nil {
+		t.Fatal("bad program ran")
+	}
+	if last := got[len(got)-1]; last != "state idle line 1: bad value X" {
+		t.Errorf("got last event %q, want the program's error", last)
+	}
+}
+
+func TestResume(t *testing.T) {
+	opts := Options{Log: func(string) {}, Signals: &SignalConfig{Spindle: 1, SpindleAnalog: 2, SpindleMax: 1000, SpindleVolts: 10}}
+	prog := "G21\nM3 S500\nG1 X10 Z-1\nG1 X20\nG1 X30\n"
+	want := `break
+line 0.00 0.00 150.00
+move 20.00 0.00 150.00
+signal 1.00 1.00
+analog 2.00 5.00
+line 20.00 0.00 -1.00
+break
+line 30.00 0.00 -1.00
+break
+`
+	rec := &staubli.Recorder{}
+	if err := New(rec, opts).RunFrom(strings.NewReader(prog), 5); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Log(); got != want {
+		t.Errorf("resuming the program, got calls\n%s\nwant\n%s", got, want)
+	}
+
+	// A plan resumes the same way.
+	p, err := New(&staubli.Recorder{}, opts).Plan(strings.NewReader(prog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = &staubli.Recorder{}
+	if err := New(rec, opts).RunPlanFrom(p, 5); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Log(); got != want {
+		t.Errorf("resuming the plan, got calls\n%s\nwant\n%s", got, want)
+	}
+
+	if err := New(&staubli.Recorder{}, opts).RunFrom(strings.NewReader(prog), 9); err == nil {
+		t.Errorf("resumed past the end of the program")
+	}
+
+	// The zero points already hold what a G10 L20 before the resume line set them to the first
+	// time, so it isn't applied again.
+	prog = "G1 X5 Y0 Z0\nG10 L20 P0 X0\nG1 X1\nG1 X2\n"
+	rec = &staubli.Recorder{}
+	e := New(rec, Options{Log: func(string) {}})
+	if err := e.Run(strings.NewReader(prog)); err != nil {
+		t.Fatal(err)
+	}
+	rec.Calls = nil
+	if err := e.RunFrom(strings.NewReader(prog), 4); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := e.wcs.Zero(), [3]float64{5, 0, 0}; got != want {
+		t.Errorf("resuming after G10 L20, got zero %v, want %v", got, want)
+	}
+	want = `break
+line 7.00 0.00 150.00
+move 6.00 0.00 150.00
+line 6.00 0.00 0.00
+break
+line 7.00 0.00 0.00
+break
+`
+	if got := rec.Log(); got != want {
+		t.Errorf("resuming after G10 L20, got calls\n%s\nwant\n%s", got, want)
+	}
+
+	// A G10 L2 before the resume line is replayed, whatever the saved zero is, and saved.
+	prog = "G10 L2 P2 X100 Y0 Z0\nG55\nG1 X10 Y0 Z0\nG1 X20\n"
+	w := NewWorkOffsets([3]float64{})
+	w.Set(1, [3]float64{300, 0, 0})
+	rec = &staubli.Recorder{}
+	e = New(rec, Options{Log: func(string) {}, WCS: w})
+	if err := e.RunFrom(strings.NewReader(prog), 4); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := w.Get(1), [3]float64{100, 0, 0}; got != want || w.State().Active != "G55" {
+		t.Errorf("resuming after G10 L2, got G55 at %v, active %s, want %v, active G55", got, w.State().Active, want)
+	}
+	want = `break
+line 0.00 0.00 150.00
+move 110.00 0.00 150.00
+line 110.00 0.00 0.00
+break
+line 120.00 0.00 0.00
+break
+`
+	if got := rec.Log(); got != want {
+		t.Errorf("resuming after G10 L2, got calls\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPlanBounds(t *testing.T) {
+	p, err := New(&staubli.Recorder{}, Options{}).Plan(strings.NewReader("G1 X10 Y-5\nM3\nG0 Z20\nG1 X-2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	min, max, ok := p.Bounds()
+	if want := [3]float64{-2, -5, 0}; !ok || min != want {
+		t.Errorf("got min %v, want %v", min, want)
+	}
+	if want := [3]float64{10, -5, 20}; max != want {
+		t.Errorf("got max %v, want %v", max, want)
+	}
+
+	if _, _, ok := (&Plan{Steps: []Step{{Line: 1, Op: OpDwell, Args: []float64{1}}}}).Bounds(); ok {
+		t.Errorf("a plan that doesn't move has bounds")
+	}
+}
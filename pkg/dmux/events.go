@@ -0,0 +1,37 @@
+package dmux
+
+// The types of Event.
+const (
+	// EventMove is sent as a move goes to the arm, with its op and arguments as a plan step
+	// would have them. Moves are queued on the controller, so the arm may not have got there yet.
+	EventMove = "move"
+	// EventMoved is sent once the arm has stopped and said where it is, in Position.
+	EventMoved = "moved"
+	// EventError is sent when the arm, or something alongside it, fails to do Op. Text says why.
+	EventError = "error"
+	// EventState is sent when the program starts, is paused or resumed, and ends, with State
+	// "running", "paused" or "idle". A program that ends in an error has it in Text.
+	EventState = "state"
+	// EventProgress is sent as the program gets to each line, with Line and Lines as in
+	// Progress.
+	EventProgress = "progress"
+)
+
+// An Event is something happening as a program runs, for the executor's Events function. Only the
+// fields its Type mentions are set. Planning a program doesn't send any.
+type Event struct {
+	Type     string
+	Op       Op          `json:",omitempty"`
+	Args     []float64   `json:",omitempty"`
+	Position *[3]float64 `json:",omitempty"`
+	State    string      `json:",omitempty"`
+	Line     int         `json:",omitempty"`
+	Lines    int         `json:",omitempty"`
+	Text     string      `json:",omitempty"`
+}
+
+func (e *Executor) emit(ev Event) {
+	if e.events != nil {
+		e.events(ev)
+	}
+}
@@ -0,0 +1,210 @@
+package dmux
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/LHSRobotics/gdmux/pkg/extruder"
+	"github.com/LHSRobotics/gdmux/pkg/gcode"
+	"github.com/LHSRobotics/gdmux/pkg/staubli"
+)
+
+// Options configure an Executor. Everything is optional: the zero value runs programs on a level
+// table with its zero at the arm's origin, with no tools, signals, plotter or extruder.
+type Options struct {
+	// Log is where progress goes, such as "Move ... → OK" for each move. By default it goes to
+	// the standard logger.
+	Log func(msg string)
+	// Verbose logs every line as it's executed.
+	Verbose bool
+	// Events, if set, is told what's going on as programs run, in more detail than the log. It's
+	// called from the goroutine running the program, so it shouldn't block.
+	Events func(ev Event)
+
+	// MeshStep is the longest straight move made without correcting the height along the way,
+	// when there's a height map.
+	MeshStep float64
+	// AngleStep is how many degrees straight moves that turn the tool are split into. Zero leaves
+	// it to the controller.
+	AngleStep float64
+
+	WCS       *WorkOffsets
+	HeightMap *HeightMap
+	Tools     *ToolTable
+	Signals   *SignalConfig
+	Plotter   *PlotterConfig
+	Park      *ParkConfig
+	Extruder  *extruder.Extruder
+
+	// Console is where M0 waits for the operator to press enter. Without one, it waits for
+	// Resume.
+	Console io.Reader
+	// OptionalStop makes M1 pause, as M0 does.
+	OptionalStop bool
+	// PlanLimit is the most lines Plan runs, counting each time a loop runs them, before giving
+	// up with ErrTooLong. Zero means there's no limit.
+	PlanLimit int
+}
+
+// Executor runs G-code programs on an arm.
+type Executor struct {
+	arm    staubli.Arm
+	log    func(msg string)
+	events func(ev Event)
+
+	verbose   bool
+	meshStep  float64
+	angleStep float64
+	planLimit int
+
+	wcs     *WorkOffsets
+	mesh    *HeightMap
+	tools   *ToolTable
+	signals *SignalConfig
+	plotter *PlotterConfig
+	parking *ParkConfig
+	ext     *extruder.Extruder
+	console *bufio.Reader
+
+	// handlers carry out the G- and M-codes, and custom holds the codes that were given to
+	// Handle rather than built in.
+	handlers map[gcode.Code]Handler
+	custom   map[gcode.Code]bool
+
+	// mu guards running, the program stops and the progress.
+	mu       sync.Mutex
+	running  bool
+	paused   bool
+	optional bool
+	message  string
+	line     int
+	lines    int
+	started  time.Time
+	pos      [3]float64
+	located  time.Time
+	// initial is a copy of the work offsets as they were when the last program started from the
+	// top, for replaying it from there when it's resumed.
+	initial *WorkOffsets
+	// resumec wakes up a paused program. Stopping the program sends on it too, so a paused
+	// program notices it's been stopped.
+	resumec chan bool
+}
+
+// New returns an executor that runs programs on arm.
+func New(arm staubli.Arm, opts Options) *Executor {
+	e := &Executor{
+		arm:       arm,
+		log:       opts.Log,
+		events:    opts.Events,
+		verbose:   opts.Verbose,
+		meshStep:  opts.MeshStep,
+		angleStep: opts.AngleStep,
+		planLimit: opts.PlanLimit,
+		wcs:       opts.WCS,
+		mesh:      opts.HeightMap,
+		tools:     opts.Tools,
+		signals:   opts.Signals,
+		plotter:   opts.Plotter,
+		parking:   opts.Park,
+		ext:       opts.Extruder,
+		handlers:  make(map[gcode.Code]Handler),
+		custom:    make(map[gcode.Code]bool),
+		optional:  opts.OptionalStop,
+		resumec:   make(chan bool, 1),
+	}
+	if e.log == nil {
+		e.log = func(msg string) {
+			log.Printf("%s", msg)
+		}
+	}
+	if e.wcs == nil {
+		e.wcs = NewWorkOffsets([3]float64{})
+	}
+	if e.tools == nil {
+		e.tools = NewToolTable()
+	}
+	if e.signals == nil {
+		sc := defaultSignals
+		e.signals = &sc
+	}
+	if e.parking == nil {
+		pc := defaultPark
+		e.parking = &pc
+	}
+	if opts.Console != nil {
+		e.console = bufio.NewReader(opts.Console)
+	}
+	e.builtins()
+	return e
+}
+
+// start marks a program as running, with its progress starting afresh. Unless it's being resumed
+// from a later line, the work offsets it starts with are kept for when it is.
+func (e *Executor) start(from int) {
+	e.mu.Lock()
+	e.running = true
+	e.line, e.lines, e.started = 0, 0, time.Now()
+	if from <= 1 {
+		e.initial = e.wcs.clone()
+	}
+	e.mu.Unlock()
+	e.emit(Event{Type: EventState, State: "running"})
+}
+
+// finish marks the program as no longer running, because it's ended with err, or been stopped.
+func (e *Executor) finish(err error) {
+	e.mu.Lock()
+	was := e.running
+	e.running = false
+	e.mu.Unlock()
+	if was || err != nil {
+		ev := Event{Type: EventState, State: "idle"}
+		if err != nil {
+			ev.Text = err.Error()
+		}
+		e.emit(ev)
+	}
+}
+
+// Running reports whether a program is running.
+func (e *Executor) Running() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.running
+}
+
+// Stop stops the running program, after the operation it's in the middle of. A paused program
+// stops straight away.
+func (e *Executor) Stop() {
+	e.finish(nil)
+	e.wake()
+}
+
+// Var returns the value of the variable v, such as 'X' or 'P', in millimetres for lengths.
+func (c *Cmd) Var(v byte) float64 {
+	return c.env[v]
+}
+
+// Has reports whether the current line sets the variable v.
+func (c *Cmd) Has(v byte) bool {
+	return c.has(v)
+}
+
+// Line returns the line being executed.
+func (c *Cmd) Line() *gcode.Line {
+	return c.line
+}
+
+// Arm returns the arm the program is running on. While planning, it records what it's asked to do
+// rather than doing it.
+func (c *Cmd) Arm() staubli.Arm {
+	return c.m
+}
+
+// Log reports progress through the executor's log.
+func (c *Cmd) Log(msg string) {
+	c.log(msg)
+}
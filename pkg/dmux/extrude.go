@@ -0,0 +1,37 @@
+package dmux
+
+import (
+	"fmt"
+	"math"
+)
+
+// startExtrusion starts the extruder on the filament the current line asks for, at a rate that
+// has it finish along with the arm's move.
+func (c *Cmd) startExtrusion() error {
+	d := c.env['E'] - c.eStart
+	if c.x.ext == nil || d == 0 {
+		return nil
+	}
+
+	// F is the feed rate along the arm's path, so scale it to the filament's. A move that's only
+	// extrusion, like a retraction, uses F as it is.
+	feed := c.env['F']
+	if l := c.pos().sub(c.start).norm(); l > 0 {
+		feed = math.Abs(d) * feed / l
+	}
+	if feed <= 0 {
+		return fmt.Errorf("no feed rate to extrude at")
+	}
+
+	c.extruding = true
+	return c.m.extrude(d, feed)
+}
+
+// finishExtrusion waits for the extruder to catch up with the arm.
+func (c *Cmd) finishExtrusion() error {
+	if !c.extruding {
+		return nil
+	}
+	c.extruding = false
+	return c.m.extruded()
+}
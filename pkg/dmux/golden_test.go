@@ -0,0 +1,104 @@
+package dmux
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/LHSRobotics/gdmux/pkg/staubli"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata with the current output")
+
+// maxGolden is the longest call log kept whole in a golden file. Longer ones are summarised.
+const maxGolden = 64 << 10
+
+// TestGolden runs every sample program through an executor and compares the calls that reach the
+// arm with testdata/<sample>.golden, so changes to how G-code is translated don't go unnoticed.
+// After a change that's meant to alter them, check the differences and run go test -update.
+//
+// The golden files of the small samples hold every call, and those of the big ones a summary.
+func TestGolden(t *testing.T) {
+	names, err := filepath.Glob("../gcode/samples/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) == 0 {
+		t.Fatal("no samples found")
+	}
+
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := &staubli.Recorder{}
+		err = New(rec, Options{Log: func(string) {}}).Run(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		got := rec.Log()
+		if len(got) > maxGolden {
+			got = summary(got)
+		}
+		golden := filepath.Join("testdata", filepath.Base(name)+".golden")
+		if *update {
+			if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		b, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Errorf("%s: %v (run go test -update to create it)", name, err)
+			continue
+		}
+		if want := string(b); got != want {
+			t.Errorf("%s: %s", name, firstDifference(got, want))
+		}
+	}
+}
+
+// summary stands in for a call log too long for a golden file that anyone would read: how many
+// calls of each kind there were, the first and last of them, and a hash of the whole log.
+func summary(log string) string {
+	calls := strings.Split(strings.TrimSuffix(log, "\n"), "\n")
+	counts := make(map[string]int)
+	for _, c := range calls {
+		counts[strings.Fields(c)[0]]++
+	}
+	var names []string
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "calls %d\n", len(calls))
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s calls %d\n", name, counts[name])
+	}
+	fmt.Fprintf(&b, "first %s\nlast %s\nsha256 %x\n", calls[0], calls[len(calls)-1], sha256.Sum256([]byte(log)))
+	return b.String()
+}
+
+// firstDifference describes where two call logs, or their summaries, first differ.
+func firstDifference(got, want string) string {
+	g, w := strings.Split(got, "\n"), strings.Split(want, "\n")
+	for i := 0; i < len(g) && i < len(w); i++ {
+		if g[i] != w[i] {
+			return fmt.Sprintf("line %d: got %q, want %q", i+1, g[i], w[i])
+		}
+	}
+	return fmt.Sprintf("got %d lines, want %d", len(g)-1, len(w)-1)
+}
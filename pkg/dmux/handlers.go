@@ -0,0 +1,328 @@
+package dmux
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/LHSRobotics/gdmux/pkg/gcode"
+	"github.com/LHSRobotics/gdmux/pkg/staubli"
+)
+
+// A Handler carries out a G- or M-code when its line is executed. The code is passed in, so one
+// handler can serve several codes. By then the line's variables have been set, and are read with
+// c.Var.
+type Handler func(c *Cmd, code gcode.Code)
+
+// Handle makes h carry out code, adding it to the codes the executor knows or replacing the
+// built-in handler. A nil h makes the code do nothing. Handled codes bypass the plotter's pen codes
+// and cutter radius compensation, so h sees them exactly as they were written.
+func (e *Executor) Handle(code gcode.Code, h Handler) {
+	e.handlers[code] = h
+	e.custom[code] = true
+}
+
+// builtin registers one of the executor's own handlers, for each of codes.
+func (e *Executor) builtin(h Handler, codes ...gcode.Code) {
+	for _, code := range codes {
+		e.handlers[code] = h
+	}
+}
+
+// builtins registers the codes the executor knows about out of the box.
+func (e *Executor) builtins() {
+	// TODO(s): I don't like how this is done, need to rethink this package...
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.Log("Move " + c.describe())
+		err := c.move()
+		if err != nil {
+			c.Log(fmt.Sprintf(" → %s\n", err))
+			return
+		}
+		err = c.m.Break()
+		if err != nil {
+			c.Log(fmt.Sprintf("break → %s\n", err))
+			return
+		}
+		c.Log(" → OK\n")
+	}, "G0")
+
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.Log("Line " + c.describe())
+		err := c.moveStraight()
+		if err != nil {
+			c.Log(fmt.Sprintf(" → %s\n", err))
+			return
+		}
+		err = c.m.Break()
+		if err != nil {
+			c.Log(fmt.Sprintf("break → %s\n", err))
+			return
+		}
+		if err := c.finishExtrusion(); err != nil {
+			c.Log(fmt.Sprintf(" → %s\n", err))
+			return
+		}
+		c.Log(" → OK\n")
+	}, "G1")
+
+	// Follow a clockwise arc.
+	//
+	// With a height map, only the end of the arc is corrected, since the arm works out the
+	// points in between itself.
+	//
+	// For now we only support the 'centre format arc'. This format gives us target coordinates
+	// and the coordinates of the centre of the circle whose arc we're following.
+	// It's not great but it's what all the slicers spit out.
+	//
+	// The other format is 'radius format arc' and that gives us target coordinates and a radius.
+	// It's probably worth supporting that at some point.
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.Log(fmt.Sprintf("Clockwise Arc to %8.2f %8.2f %8.2f, around %8.2f %8.2f %8.2f", c.env['X'], c.env['Y'], c.env['Z'], c.env['I'], c.env['J'], c.env['K']))
+		// TODO add a step argument here and use negative to go anti-clockwise.
+		err := c.arc(staubli.Clockwise)
+		if err != nil {
+			c.Log(fmt.Sprintf(" → %s\n", err))
+			return
+		}
+		c.Log(" → OK\n")
+	}, "G2")
+
+	// Follow an anti-clockwise arc.
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.Log(fmt.Sprintf("Anti-clockwise Arc to %8.2f %8.2f %8.2f, around %8.2f %8.2f %8.2f", c.env['X'], c.env['Y'], c.env['Z'], c.env['I'], c.env['J'], c.env['K']))
+		// TODO add a step argument here and use negative to go anti-clockwise.
+		err := c.arc(staubli.Anticlockwise)
+		if err != nil {
+			c.Log(fmt.Sprintf(" → %s\n", err))
+			return
+		}
+		c.Log(" → OK\n")
+	}, "G3")
+
+	// Already handled by SetModes.
+	e.builtin(nil, "G20", "G21", "G90", "G91", "G90.1", "G91.1", "M82", "M83", "G80", "G98", "G99",
+		"G40", "G41", "G42")
+
+	// Make the current position read as the line's axis words, without moving. Axes that
+	// aren't on the line keep their position, and so their offset.
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.offset.x += c.start.x - c.env['X']
+		c.offset.y += c.start.y - c.env['Y']
+		c.offset.z += c.start.z - c.env['Z']
+		c.Log(fmt.Sprintf("Offset %8.2f %8.2f %8.2f\n", c.offset.x, c.offset.y, c.offset.z))
+	}, "G92")
+
+	// Drop the G92 offset, keeping the arm where it is.
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.env['X'] += c.offset.x
+		c.env['Y'] += c.offset.y
+		c.env['Z'] += c.offset.z
+		c.offset = point{}
+		c.Log("Offset cleared\n")
+	}, "G92.1")
+
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		i, _ := WCSIndex(string(code))
+		if err := c.m.selectWCS(i); err != nil {
+			c.Log(fmt.Sprintf("%s → %s\n", code, err))
+			return
+		}
+		c.Log(fmt.Sprintf("Using %s\n", code))
+	}, "G54", "G55", "G56", "G57", "G58", "G59")
+
+	// Set the zero point of the coordinate system given by P (P1 for G54, up to P6 for G59,
+	// or P0 for the active one). With L2 the axis words are the new zero point in arm
+	// coordinates, with L20 they're what the current position should read as.
+	//
+	// The axis words aren't a move, so the position is restored afterwards.
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		defer func() {
+			c.env['X'], c.env['Y'], c.env['Z'] = c.start.x, c.start.y, c.start.z
+		}()
+
+		p := int(c.env['P']) - 1
+		if !c.has('P') || p >= len(WCSNames) || p < -1 {
+			c.Log(fmt.Sprintf("G10 → bad coordinate system P%v\n", c.env['P']))
+			return
+		}
+		l := c.env['L']
+		if !c.has('L') || (l != 2 && l != 20) {
+			c.Log(fmt.Sprintf("G10 → unsupported L%v\n", l))
+			return
+		}
+
+		zero := vec(c.wcs.Get(p))
+		if l == 2 {
+			if c.has('X') {
+				zero.x = c.env['X']
+			}
+			if c.has('Y') {
+				zero.y = c.env['Y']
+			}
+			if c.has('Z') {
+				zero.z = c.env['Z']
+			}
+		} else {
+			// What the current position reads as in system p, G92 offset and all, and how far
+			// off that is from what the line says it should read. The axes that aren't given
+			// keep reading as they do now.
+			plane := c.wcs.Plane()
+			read := plane.unapply(vec(c.wcs.Zero()).sub(zero)).add(c.start)
+			var d point
+			if c.has('X') {
+				d.x = read.x - c.env['X']
+			}
+			if c.has('Y') {
+				d.y = read.y - c.env['Y']
+			}
+			if c.has('Z') {
+				d.z = read.z - c.env['Z']
+			}
+			zero = zero.add(plane.apply(d))
+		}
+
+		if err := c.m.setZero(p, zero.array()); err != nil {
+			c.Log(fmt.Sprintf("G10 → %s\n", err))
+			return
+		}
+		c.Log(fmt.Sprintf("Zero %8.2f %8.2f %8.2f\n", zero.x, zero.y, zero.z))
+	}, "G10")
+
+	// Change to the tool selected by T. We can't change tools ourselves, so this just records
+	// which tool the operator has put on.
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		id := int(c.env['T'])
+		if err := c.m.mount(id); err != nil {
+			c.Log(fmt.Sprintf("M6 → %s\n", err))
+			return
+		}
+		if t := c.tools.Mounted(); t != nil {
+			c.Log(fmt.Sprintf("Using tool %d (%s)\n", id, t.Name))
+		} else {
+			c.Log("Using no tool\n")
+		}
+	}, "M6")
+
+	// Apply the length of the tool given by H, or of the mounted tool if there's no H.
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		t := c.tools.Mounted()
+		if c.has('H') {
+			var err error
+			if t, err = c.tools.Get(int(c.env['H'])); err != nil {
+				c.Log(fmt.Sprintf("G43 → %s\n", err))
+				return
+			}
+		}
+		if t == nil {
+			c.Log("G43 → no tool mounted\n")
+			return
+		}
+		c.length = t.Offset[2]
+		c.Log(fmt.Sprintf("Tool length %8.2f\n", c.length))
+	}, "G43")
+
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.length = 0
+		c.Log("Tool length cleared\n")
+	}, "G49")
+
+	// Turn the spindle or laser on, with the power from S.
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.spindle(string(code), true, code == "M4")
+	}, "M3", "M4")
+
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.spindle("M5", false, false)
+	}, "M5")
+
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.signal("M7", c.x.signals.Mist, true)
+	}, "M7")
+
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.signal("M8", c.x.signals.Flood, true)
+	}, "M8")
+
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		if c.x.signals.Mist != 0 {
+			c.signal("M9", c.x.signals.Mist, false)
+		}
+		if c.x.signals.Flood != 0 {
+			c.signal("M9", c.x.signals.Flood, false)
+		}
+	}, "M9")
+
+	// Turn the output given by P on (M62, M64) or off (M63, M65). M64 and M65 do it straight
+	// away, M62 and M63 when the next move starts.
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		on := code == "M62" || code == "M64"
+		n, err := c.x.signals.output(c.env['P'])
+		if err != nil {
+			c.Log(fmt.Sprintf("%s → %s\n", code, err))
+			return
+		}
+		if code == "M62" || code == "M63" {
+			c.synced = append(c.synced, func(c *Cmd) { c.signal(string(code), n, on) })
+			return
+		}
+		c.signal(string(code), n, on)
+	}, "M62", "M63", "M64", "M65")
+
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.waitInput()
+	}, "M66")
+
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.probe()
+	}, "G38.2")
+
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.drill()
+	}, "G81", "G82", "G83")
+
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		s := c.dwellTime()
+		c.Log(fmt.Sprintf("Dwell %.3fs", s))
+		c.m.dwell(s)
+		c.Log(" → OK\n")
+	}, "G4")
+
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		at := c.x.parking.G28
+		if code == "G30" {
+			at = c.x.parking.G30
+		}
+		if err := c.park(string(code), at); err != nil {
+			c.Log(fmt.Sprintf(" → %s\n", err))
+			c.m.stop()
+			return
+		}
+		c.Log(" → OK\n")
+	}, "G28", "G30")
+
+	// Pause until the operator resumes, always for M0 and with optional stops on for M1.
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.m.pause(string(code))
+	}, "M0", "M1")
+
+	// End the program, leaving the spindle off and the pen up.
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		if c.spindleOn {
+			c.spindle(string(code), false, false)
+		}
+		if c.penDown {
+			c.pen(false)
+		}
+		c.done = true
+	}, "M2", "M30")
+
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		c.m.message(c.line.Message)
+	}, "M117")
+
+	e.builtin(func(c *Cmd, code gcode.Code) {
+		log.Printf("ignoring: fanoff M107.")
+	}, "M107")
+
+	e.builtin(nil, "M103", "M101")
+}
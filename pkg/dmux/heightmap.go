@@ -0,0 +1,174 @@
+package dmux
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HeightMap holds how far the work surface is above (or below) Z=0 on a regular grid of points,
+// so that moves can follow a warped board. Coordinates are those of the work coordinate system.
+type HeightMap struct {
+	// X0 and Y0 are the coordinates of the first grid point, DX and DY the grid spacing.
+	X0, Y0, DX, DY float64
+	// Z holds the heights, one row per y value, one column per x value.
+	Z [][]float64
+}
+
+// LoadHeightMap reads a height map from a file. JSON files hold a heightMap, anything else is taken
+// to be CSV with an x,y,z line per grid point, which is what a probing routine naturally spits out.
+func LoadHeightMap(name string) (*HeightMap, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var m *HeightMap
+	if strings.ToLower(filepath.Ext(name)) == ".json" {
+		m = &HeightMap{}
+		err = json.NewDecoder(f).Decode(m)
+	} else {
+		m, err = readHeightCSV(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading height map %s: %s", name, err)
+	}
+	if err := m.check(); err != nil {
+		return nil, fmt.Errorf("bad height map %s: %s", name, err)
+	}
+	return m, nil
+}
+
+// gridTolerance is how far, in mm, the points of a CSV height map can be from an evenly spaced
+// grid.
+const gridTolerance = 0.01
+
+// readHeightCSV reads x,y,z lines into a grid. The points can be in any order, but they have to
+// cover every combination of the x and y values that appear, and those have to be evenly spaced.
+func readHeightCSV(r io.Reader) (*HeightMap, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 3
+	cr.TrimLeadingSpace = true
+
+	type xy struct{ x, y float64 }
+	heights := make(map[xy]float64)
+	xs, ys := make(map[float64]bool), make(map[float64]bool)
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		var v [3]float64
+		for i, s := range rec {
+			if v[i], err = strconv.ParseFloat(s, 64); err != nil {
+				return nil, err
+			}
+		}
+		heights[xy{v[0], v[1]}] = v[2]
+		xs[v[0]], ys[v[1]] = true, true
+	}
+
+	sortedKeys := func(m map[float64]bool) []float64 {
+		var s []float64
+		for k := range m {
+			s = append(s, k)
+		}
+		sort.Float64s(s)
+		return s
+	}
+	gx, gy := sortedKeys(xs), sortedKeys(ys)
+	if len(gx) < 2 || len(gy) < 2 {
+		return nil, fmt.Errorf("need at least a 2×2 grid")
+	}
+
+	m := &HeightMap{
+		X0: gx[0], Y0: gy[0],
+		DX: (gx[len(gx)-1] - gx[0]) / float64(len(gx)-1),
+		DY: (gy[len(gy)-1] - gy[0]) / float64(len(gy)-1),
+	}
+	even := func(g []float64, d float64) bool {
+		for i := 1; i < len(g); i++ {
+			if math.Abs(g[i]-g[i-1]-d) > gridTolerance {
+				return false
+			}
+		}
+		return true
+	}
+	if !even(gx, m.DX) {
+		return nil, fmt.Errorf("the x values aren't evenly spaced")
+	}
+	if !even(gy, m.DY) {
+		return nil, fmt.Errorf("the y values aren't evenly spaced")
+	}
+	for _, y := range gy {
+		row := make([]float64, len(gx))
+		for i, x := range gx {
+			z, ok := heights[xy{x, y}]
+			if !ok {
+				return nil, fmt.Errorf("missing grid point %v,%v", x, y)
+			}
+			row[i] = z
+		}
+		m.Z = append(m.Z, row)
+	}
+	return m, nil
+}
+
+func (m *HeightMap) check() error {
+	if m.DX <= 0 || m.DY <= 0 {
+		return fmt.Errorf("grid spacing must be positive")
+	}
+	if len(m.Z) < 2 || len(m.Z[0]) < 2 {
+		return fmt.Errorf("need at least a 2×2 grid")
+	}
+	for _, row := range m.Z {
+		if len(row) != len(m.Z[0]) {
+			return fmt.Errorf("rows have different lengths")
+		}
+	}
+	return nil
+}
+
+// at returns the height of the surface at (x,y), interpolated bilinearly between the four nearest
+// grid points. Outside the grid, the height at the nearest edge is used.
+func (m *HeightMap) at(x, y float64) float64 {
+	cell := func(v, v0, dv float64, n int) (int, float64) {
+		f := (v - v0) / dv
+		if f <= 0 {
+			return 0, 0
+		}
+		if f >= float64(n-1) {
+			return n - 2, 1
+		}
+		i := int(f)
+		return i, f - float64(i)
+	}
+	i, fx := cell(x, m.X0, m.DX, len(m.Z[0]))
+	j, fy := cell(y, m.Y0, m.DY, len(m.Z))
+
+	z0 := m.Z[j][i]*(1-fx) + m.Z[j][i+1]*fx
+	z1 := m.Z[j+1][i]*(1-fx) + m.Z[j+1][i+1]*fx
+	return z0*(1-fy) + z1*fy
+}
+
+// segments returns how many pieces a straight move from a to b should be split into, so that the
+// height correction is applied every step or so along the way.
+func (m *HeightMap) segments(a, b point, step float64) int {
+	if m == nil || step <= 0 {
+		return 1
+	}
+	d := math.Hypot(b.x-a.x, b.y-a.y)
+	return int(math.Max(1, math.Ceil(d/step)))
+}
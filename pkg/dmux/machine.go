@@ -0,0 +1,239 @@
+package dmux
+
+import (
+	"errors"
+	"time"
+
+	"github.com/LHSRobotics/gdmux/pkg/staubli"
+)
+
+// machine is everything a program does to the outside world: the arm's moves and signals, and the
+// waits, pauses, extrusion and settings that go along with them. Running a program drives the real
+// thing, and planning one writes it all down instead.
+type machine interface {
+	staubli.Arm
+
+	// dwell waits for the given number of seconds.
+	dwell(seconds float64)
+	// pause waits for the operator, for an M0, or for an M1 with optional stops on.
+	pause(code string)
+	// message passes an M117 message on to the operator.
+	message(msg string)
+	// wait waits on digital input n, as M66 does, returning 1 or 0 for the input's final state or
+	// -1 for a timeout. A negative timeout waits for as long as it takes.
+	wait(n, mode int, timeout float64) (float64, error)
+	// extrude starts the extruder on mm of filament at the given feed rate, and extruded waits
+	// for it to finish.
+	extrude(mm, feed float64) error
+	extruded() error
+	// selectWCS, setZero and mount change the work offsets and the mounted tool, which outlive
+	// the program.
+	selectWCS(i int) error
+	setZero(i int, z [3]float64) error
+	mount(id int) error
+
+	// progress reports that the program has got to line of lines.
+	progress(line, lines int)
+
+	running() bool
+	stop()
+}
+
+// errStopped is returned by waits that end because the program was stopped.
+var errStopped = errors.New("stopped")
+
+// live is the machine for real: the executor's arm, extruder and settings.
+type live struct {
+	staubli.Arm
+	e *Executor
+}
+
+// dwell waits for the given number of seconds, or until the program is stopped.
+func (l live) dwell(seconds float64) {
+	deadline := time.Now().Add(time.Duration(seconds * float64(time.Second)))
+	for l.e.Running() {
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			return
+		}
+		if left > inputPoll {
+			left = inputPoll
+		}
+		time.Sleep(left)
+	}
+}
+
+func (l live) pause(code string) {
+	if code == "M1" && !l.e.OptionalStop() {
+		return
+	}
+	l.e.waitResume(code)
+}
+
+func (l live) message(msg string) {
+	l.e.showMessage(msg)
+}
+
+// wait reads the input until it does what mode asks for. Mode 0 just reads it, 1 waits for it to
+// come on, 2 for it to go off, 3 for it to be on and 4 for it to be off.
+func (l live) wait(n, mode int, timeout float64) (float64, error) {
+	var deadline time.Time
+	if timeout >= 0 {
+		deadline = time.Now().Add(time.Duration(timeout * float64(time.Second)))
+	}
+
+	state, err := l.Input(n)
+	last := state
+	for {
+		if err != nil {
+			return 0, err
+		}
+
+		var done bool
+		switch mode {
+		case 0:
+			done = true
+		case 1:
+			done = state && !last
+		case 2:
+			done = !state && last
+		case 3:
+			done = state
+		case 4:
+			done = !state
+		}
+		if done {
+			if state {
+				return 1, nil
+			}
+			return 0, nil
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return -1, nil
+		}
+		if !l.e.Running() {
+			return 0, errStopped
+		}
+
+		time.Sleep(inputPoll)
+		last = state
+		state, err = l.Input(n)
+	}
+}
+
+func (l live) extrude(mm, feed float64) error {
+	if l.e.ext == nil {
+		return l.failed(OpExtrude, errors.New("no extruder"))
+	}
+	return l.failed(OpExtrude, l.e.ext.Start(mm, feed))
+}
+
+func (l live) extruded() error {
+	if l.e.ext == nil {
+		return l.failed(OpExtruded, errors.New("no extruder"))
+	}
+	return l.failed(OpExtruded, l.e.ext.Wait())
+}
+
+func (l live) selectWCS(i int) error {
+	return l.e.wcs.Select(i)
+}
+
+func (l live) setZero(i int, z [3]float64) error {
+	return l.e.wcs.Set(i, z)
+}
+
+func (l live) mount(id int) error {
+	return l.e.tools.Mount(id)
+}
+
+// The arm's methods are passed on to it, telling the executor's Events function about moves and
+// errors along the way.
+
+// moving sends an EventMove for a move about to go to the arm.
+func (l live) moving(op Op, args ...float64) {
+	l.e.emit(Event{Type: EventMove, Op: op, Args: args})
+}
+
+// failed sends an EventError if err is set, and returns it.
+func (l live) failed(op Op, err error) error {
+	if err != nil {
+		l.e.emit(Event{Type: EventError, Op: op, Text: err.Error()})
+	}
+	return err
+}
+
+// located passes on the arm's position, once it's stopped and said where it is, if err says it
+// has.
+func (l live) located(op Op, err error) error {
+	if err != nil {
+		return l.failed(op, err)
+	}
+	x, y, z := l.Position()
+	l.e.setPosition([3]float64{x, y, z})
+	return nil
+}
+
+func (l live) Move(x, y, z float64) error {
+	l.moving(OpMove, x, y, z)
+	return l.failed(OpMove, l.Arm.Move(x, y, z))
+}
+
+func (l live) MoveStraight(x, y, z float64) error {
+	l.moving(OpLine, x, y, z)
+	return l.failed(OpLine, l.Arm.MoveStraight(x, y, z))
+}
+
+func (l live) Move6DOF(x, y, z, yaw, pitch, roll float64) error {
+	l.moving(OpMove6, x, y, z, yaw, pitch, roll)
+	return l.failed(OpMove6, l.Arm.Move6DOF(x, y, z, yaw, pitch, roll))
+}
+
+func (l live) MoveStraight6DOF(x, y, z, yaw, pitch, roll float64) error {
+	l.moving(OpLine6, x, y, z, yaw, pitch, roll)
+	return l.failed(OpLine6, l.Arm.MoveStraight6DOF(x, y, z, yaw, pitch, roll))
+}
+
+func (l live) ArcCenter(x, y, z, i, j, k, direction float64) error {
+	l.moving(OpArc, x, y, z, i, j, k, direction)
+	return l.failed(OpArc, l.Arm.ArcCenter(x, y, z, i, j, k, direction))
+}
+
+func (l live) Break() error {
+	return l.located(OpBreak, l.Arm.Break())
+}
+
+func (l live) Probe(x, y, z float64, n int) error {
+	l.moving(OpProbe, x, y, z, float64(n))
+	return l.located(OpProbe, l.Arm.Probe(x, y, z, n))
+}
+
+func (l live) Ready() error {
+	l.moving(OpReady)
+	return l.located(OpReady, l.Arm.Ready())
+}
+
+func (l live) Signal(n int, on bool) error {
+	return l.failed(OpSignal, l.Arm.Signal(n, on))
+}
+
+func (l live) Analog(channel int, value float64) error {
+	return l.failed(OpAnalog, l.Arm.Analog(channel, value))
+}
+
+func (l live) Input(n int) (bool, error) {
+	on, err := l.Arm.Input(n)
+	return on, l.failed(OpInput, err)
+}
+
+func (l live) progress(line, lines int) {
+	l.e.setLine(line, lines)
+}
+
+func (l live) running() bool {
+	return l.e.Running()
+}
+
+func (l live) stop() {
+	l.e.Stop()
+}
@@ -0,0 +1,106 @@
+package dmux
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// ParkConfig says where G28 and G30 take the arm.
+type ParkConfig struct {
+	// SafeZ is the arm's z the tool is lifted to, straight up, before going anywhere, so that it
+	// doesn't drag through the work.
+	SafeZ float64
+	// G28 and G30 are the arm coordinates of the flange's park positions. Without one, the arm
+	// goes to its READY position.
+	G28 *[3]float64
+	G30 *[3]float64
+}
+
+// defaultPark is where the arm parks without a configuration. The safe height is the one gcode.pg
+// starts out at.
+var defaultPark = ParkConfig{SafeZ: 150}
+
+// LoadPark reads the park positions from a JSON file.
+func LoadPark(name string) (*ParkConfig, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pc := &ParkConfig{SafeZ: 150}
+	if err := json.NewDecoder(f).Decode(pc); err != nil {
+		return nil, fmt.Errorf("error reading park positions %s: %s", name, err)
+	}
+	return pc, nil
+}
+
+// dwellTime returns how long a G4 waits for. P is in milliseconds and S in seconds, like the
+// RepRap firmwares that slicers write for.
+func (c *Cmd) dwellTime() float64 {
+	var seconds float64
+	if c.has('P') {
+		seconds = c.env['P'] / 1000
+	}
+	// S is the spindle speed everywhere else, so it's never put in env for a G4.
+	for _, code := range c.line.Codes {
+		if code[0] == 'S' {
+			s, err := strconv.ParseFloat(string(code[1:]), 64)
+			if err != nil {
+				c.Log(fmt.Sprintf("G4 → bad dwell time %s\n", code))
+				return 0
+			}
+			seconds = s
+		}
+	}
+	return seconds
+}
+
+// park lifts the tool to the safe height and then moves the arm to the park position for code,
+// going through the position on the line first if it has any axis words.
+//
+// The program's position isn't changed, so the first move after parking should be an absolute
+// one.
+func (c *Cmd) park(code string, at *[3]float64) error {
+	if c.penDown {
+		if err := c.pen(false); err != nil {
+			return err
+		}
+	}
+	if c.has('X') || c.has('Y') || c.has('Z') || c.has('A') || c.has('B') || c.has('C') {
+		c.Log("Move " + c.describe())
+		if err := c.move(); err != nil {
+			return err
+		}
+		c.Log(" → OK\n")
+	}
+	c.sync()
+
+	p := c.flange(c.toArm(c.at).pose())
+	if p.Z < c.x.parking.SafeZ {
+		p.Z = c.x.parking.SafeZ
+		c.Log(fmt.Sprintf("%s: lift to %8.2f", code, p.Z))
+		var err error
+		if c.sixDOF() {
+			err = c.m.MoveStraight6DOF(p.X, p.Y, p.Z, p.Yaw, p.Pitch, p.Roll)
+		} else {
+			err = c.m.MoveStraight(p.X, p.Y, p.Z)
+		}
+		if err != nil {
+			return err
+		}
+		c.Log(" → OK\n")
+	}
+
+	if at == nil {
+		c.Log(fmt.Sprintf("%s: park at READY", code))
+		return c.m.Ready()
+	}
+	c.Log(fmt.Sprintf("%s: park at %8.2f %8.2f %8.2f", code, at[0], at[1], at[2]))
+	if err := c.m.Move(at[0], at[1], at[2]); err != nil {
+		return err
+	}
+	return c.m.Break()
+}
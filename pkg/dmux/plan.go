@@ -0,0 +1,564 @@
+package dmux
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/LHSRobotics/gdmux/pkg/gcode"
+)
+
+// Op says what a Step does.
+type Op string
+
+// The steps a plan is made of, and their arguments. Positions are the flange's, in arm
+// coordinates, and orientations V+ Euler angles, as the staubli.Arm methods take them.
+const (
+	OpMove     Op = "move"     // x y z: move to a position, any which way
+	OpLine     Op = "line"     // x y z: move in a straight line
+	OpMove6    Op = "move6"    // x y z yaw pitch roll
+	OpLine6    Op = "line6"    // x y z yaw pitch roll
+	OpArc      Op = "arc"      // x y z i j k direction: follow an arc around i, j, k
+	OpBreak    Op = "break"    // wait for the arm to finish moving
+	OpReady    Op = "ready"    // go to the READY position
+	OpSignal   Op = "signal"   // n on: set digital output n, 1 for on and 0 for off
+	OpAnalog   Op = "analog"   // channel volts
+	OpInput    Op = "input"    // n state: read digital input n, which should be in state
+	OpWait     Op = "wait"     // n mode timeout result: an M66 wait, which should end in result
+	OpProbe    Op = "probe"    // x y z n: move until input n comes on, which should be at x y z
+	OpDwell    Op = "dwell"    // seconds
+	OpPause    Op = "pause"    // wait for the operator; the text is M0, or M1 for an optional stop
+	OpMessage  Op = "message"  // show the text to the operator
+	OpExtrude  Op = "extrude"  // mm feed: start the extruder
+	OpExtruded Op = "extruded" // wait for the extruder to finish
+	OpWCS      Op = "wcs"      // i: select work coordinate system i
+	OpZero     Op = "zero"     // i x y z: set the zero point of system i, or the active one for -1
+	OpTool     Op = "tool"     // id: record that tool id has been mounted
+)
+
+// opArgs is how many arguments each step takes.
+var opArgs = map[Op]int{
+	OpMove: 3, OpLine: 3, OpMove6: 6, OpLine6: 6, OpArc: 7, OpBreak: 0, OpReady: 0,
+	OpSignal: 2, OpAnalog: 2, OpInput: 2, OpWait: 4, OpProbe: 4,
+	OpDwell: 1, OpPause: 0, OpMessage: 0, OpExtrude: 2, OpExtruded: 0,
+	OpWCS: 1, OpZero: 4, OpTool: 1,
+}
+
+// probeSlack is how far, in millimetres, a probe can touch from where the plan expected it to and
+// still carry on with the plan.
+const probeSlack = 0.01
+
+// A Step is one thing the arm, or something alongside it, does. Line is the line of the program
+// it came from.
+type Step struct {
+	Line int       `json:"line"`
+	Op   Op        `json:"op"`
+	Args []float64 `json:"args,omitempty"`
+	Text string    `json:"text,omitempty"`
+}
+
+func (s Step) String() string {
+	t := fmt.Sprintf("%d: %s", s.Line, s.Op)
+	for _, a := range s.Args {
+		t += " " + strconv.FormatFloat(a, 'f', -1, 64)
+	}
+	if s.Text != "" {
+		t += " " + strconv.Quote(s.Text)
+	}
+	return t
+}
+
+// integral reports whether v is a whole number between min and max.
+func integral(v float64, min, max int) bool {
+	return v == math.Floor(v) && v >= float64(min) && v <= float64(max)
+}
+
+// check makes sure the step makes sense.
+func (s Step) check() error {
+	n, ok := opArgs[s.Op]
+	if !ok {
+		return fmt.Errorf("unknown op %q", s.Op)
+	}
+	if len(s.Args) != n {
+		return fmt.Errorf("%s takes %d arguments, not %d", s.Op, n, len(s.Args))
+	}
+	for _, a := range s.Args {
+		if math.IsNaN(a) || math.IsInf(a, 0) {
+			return fmt.Errorf("bad argument %v", a)
+		}
+	}
+
+	a := s.Args
+	switch s.Op {
+	case OpArc:
+		if a[6] != 1 && a[6] != -1 {
+			return fmt.Errorf("arc direction must be 1 or -1")
+		}
+	case OpSignal, OpInput:
+		if !integral(a[0], 1, math.MaxInt32) || !integral(a[1], 0, 1) {
+			return fmt.Errorf("%s needs a signal number and 0 or 1", s.Op)
+		}
+	case OpAnalog:
+		if !integral(a[0], 1, math.MaxInt32) {
+			return fmt.Errorf("bad analog channel %v", a[0])
+		}
+	case OpWait:
+		if !integral(a[0], 1, math.MaxInt32) || !integral(a[1], 0, 4) || !integral(a[3], -1, 1) {
+			return fmt.Errorf("wait needs an input, a mode from 0 to 4, a timeout and a result")
+		}
+	case OpProbe:
+		if !integral(a[3], 1, math.MaxInt32) {
+			return fmt.Errorf("bad probe input %v", a[3])
+		}
+	case OpDwell:
+		if a[0] < 0 {
+			return fmt.Errorf("negative dwell")
+		}
+	case OpPause:
+		if s.Text != "M0" && s.Text != "M1" {
+			return fmt.Errorf("pause must be for M0 or M1")
+		}
+	case OpWCS:
+		if !integral(a[0], 0, len(WCSNames)-1) {
+			return fmt.Errorf("bad coordinate system %v", a[0])
+		}
+	case OpZero:
+		if !integral(a[0], -1, len(WCSNames)-1) {
+			return fmt.Errorf("bad coordinate system %v", a[0])
+		}
+	case OpTool:
+		if !integral(a[0], 0, math.MaxInt32) {
+			return fmt.Errorf("bad tool %v", a[0])
+		}
+	}
+	return nil
+}
+
+// run carries out the step on m.
+func (s Step) run(m machine) error {
+	a := s.Args
+	switch s.Op {
+	case OpMove:
+		return m.Move(a[0], a[1], a[2])
+	case OpLine:
+		return m.MoveStraight(a[0], a[1], a[2])
+	case OpMove6:
+		return m.Move6DOF(a[0], a[1], a[2], a[3], a[4], a[5])
+	case OpLine6:
+		return m.MoveStraight6DOF(a[0], a[1], a[2], a[3], a[4], a[5])
+	case OpArc:
+		return m.ArcCenter(a[0], a[1], a[2], a[3], a[4], a[5], a[6])
+	case OpBreak:
+		return m.Break()
+	case OpReady:
+		return m.Ready()
+	case OpSignal:
+		return m.Signal(int(a[0]), a[1] == 1)
+	case OpAnalog:
+		return m.Analog(int(a[0]), a[1])
+	case OpInput:
+		on, err := m.Input(int(a[0]))
+		if err != nil {
+			return err
+		}
+		if on != (a[1] == 1) {
+			return fmt.Errorf("input %v is %v, the plan assumed %v", a[0], on, a[1] == 1)
+		}
+	case OpWait:
+		v, err := m.wait(int(a[0]), int(a[1]), a[2])
+		if err != nil {
+			return err
+		}
+		if v != a[3] {
+			return fmt.Errorf("input %v gave %v, the plan assumed %v", a[0], v, a[3])
+		}
+	case OpProbe:
+		if err := m.Probe(a[0], a[1], a[2], int(a[3])); err != nil {
+			return err
+		}
+		x, y, z := m.Position()
+		if math.Abs(x-a[0]) > probeSlack || math.Abs(y-a[1]) > probeSlack || math.Abs(z-a[2]) > probeSlack {
+			return fmt.Errorf("touched at %.2f %.2f %.2f, the plan assumed %.2f %.2f %.2f", x, y, z, a[0], a[1], a[2])
+		}
+	case OpDwell:
+		m.dwell(a[0])
+	case OpPause:
+		m.pause(s.Text)
+	case OpMessage:
+		m.message(s.Text)
+	case OpExtrude:
+		return m.extrude(a[0], a[1])
+	case OpExtruded:
+		return m.extruded()
+	case OpWCS:
+		return m.selectWCS(int(a[0]))
+	case OpZero:
+		return m.setZero(int(a[0]), [3]float64{a[1], a[2], a[3]})
+	case OpTool:
+		return m.mount(int(a[0]))
+	}
+	return nil
+}
+
+// A Plan is what running a program does, step by step, worked out in advance so it can be looked
+// over, saved and compared before the arm moves.
+type Plan struct {
+	Steps []Step `json:"steps"`
+}
+
+// Validate checks that every step is one the executor knows, with sensible arguments.
+func (p *Plan) Validate() error {
+	for i, s := range p.Steps {
+		if err := s.check(); err != nil {
+			return fmt.Errorf("step %d (line %d): %s", i+1, s.Line, err)
+		}
+	}
+	return nil
+}
+
+// Bounds returns the corners of the box around where the plan's moves and probes go, or false if
+// it doesn't go anywhere. Arcs only count their ends, so one that bulges out of the box isn't
+// caught.
+func (p *Plan) Bounds() (min, max [3]float64, ok bool) {
+	for _, s := range p.Steps {
+		switch s.Op {
+		case OpMove, OpLine, OpMove6, OpLine6, OpArc, OpProbe:
+		default:
+			continue
+		}
+		for i := range min {
+			if !ok || s.Args[i] < min[i] {
+				min[i] = s.Args[i]
+			}
+			if !ok || s.Args[i] > max[i] {
+				max[i] = s.Args[i]
+			}
+		}
+		ok = true
+	}
+	return min, max, ok
+}
+
+// WriteJSON writes the plan as JSON, with a step to a line so that plans diff nicely.
+func (p *Plan) WriteJSON(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("{\"steps\": [")
+	for i, s := range p.Steps {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			bw.WriteString(",")
+		}
+		bw.WriteString("\n\t")
+		bw.Write(b)
+	}
+	bw.WriteString("\n]}\n")
+	return bw.Flush()
+}
+
+// ReadPlan reads a plan saved as JSON, and validates it.
+func ReadPlan(r io.Reader) (*Plan, error) {
+	var p Plan
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, fmt.Errorf("error reading plan: %s", err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// planner is the machine a program is planned on. It writes down what it's asked to do, and
+// keeps its own copies of the work offsets and tools for the program's changes to them.
+type planner struct {
+	cmd   *Cmd
+	plan  *Plan
+	wcs   *WorkOffsets
+	tools *ToolTable
+	// at is where the last move went, for Position.
+	at [3]float64
+
+	stopped bool
+	// text is what's been logged since the last complete line, which ends up in last.
+	text, last string
+	// reason and line say why and where the program was stopped.
+	reason string
+	line   int
+	// ran counts the lines run, for stopping at limit, if it's set.
+	ran, limit int
+	// counted is the last line counted in ran. Compensated moves report their line again when
+	// they're made, which doesn't count.
+	counted *gcode.Line
+}
+
+// ErrTooLong is returned by Plan for a program that runs more lines than Options.PlanLimit.
+var ErrTooLong = errors.New("too long to plan")
+
+// round rounds to a millionth, which is well below anything the arm can do, so plans made from
+// the same program compare equal.
+func round(v float64) float64 {
+	return math.Floor(v*1e6+0.5) / 1e6
+}
+
+func (p *planner) lineNumber() int {
+	if p.cmd.line == nil {
+		return 0
+	}
+	return p.cmd.line.Number
+}
+
+func (p *planner) add(op Op, text string, args ...float64) {
+	for i := range args {
+		args[i] = round(args[i])
+	}
+	p.plan.Steps = append(p.plan.Steps, Step{Line: p.lineNumber(), Op: op, Args: args, Text: text})
+}
+
+func truth(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (p *planner) Move(x, y, z float64) error {
+	p.add(OpMove, "", x, y, z)
+	p.at = [3]float64{x, y, z}
+	return nil
+}
+
+func (p *planner) MoveStraight(x, y, z float64) error {
+	p.add(OpLine, "", x, y, z)
+	p.at = [3]float64{x, y, z}
+	return nil
+}
+
+func (p *planner) Move6DOF(x, y, z, yaw, pitch, roll float64) error {
+	p.add(OpMove6, "", x, y, z, yaw, pitch, roll)
+	p.at = [3]float64{x, y, z}
+	return nil
+}
+
+func (p *planner) MoveStraight6DOF(x, y, z, yaw, pitch, roll float64) error {
+	p.add(OpLine6, "", x, y, z, yaw, pitch, roll)
+	p.at = [3]float64{x, y, z}
+	return nil
+}
+
+func (p *planner) ArcCenter(x, y, z, i, j, k, direction float64) error {
+	p.add(OpArc, "", x, y, z, i, j, k, direction)
+	p.at = [3]float64{x, y, z}
+	return nil
+}
+
+func (p *planner) Break() error {
+	p.add(OpBreak, "")
+	return nil
+}
+
+func (p *planner) Ready() error {
+	p.add(OpReady, "")
+	return nil
+}
+
+func (p *planner) Position() (x, y, z float64) {
+	return p.at[0], p.at[1], p.at[2]
+}
+
+func (p *planner) Signal(n int, on bool) error {
+	p.add(OpSignal, "", float64(n), truth(on))
+	return nil
+}
+
+func (p *planner) Analog(channel int, value float64) error {
+	p.add(OpAnalog, "", float64(channel), value)
+	return nil
+}
+
+// Input assumes inputs are off, when read without waiting for them.
+func (p *planner) Input(n int) (bool, error) {
+	p.add(OpInput, "", float64(n), 0)
+	return false, nil
+}
+
+// Probe assumes the probe touches at the target.
+func (p *planner) Probe(x, y, z float64, n int) error {
+	p.add(OpProbe, "", x, y, z, float64(n))
+	p.at = [3]float64{x, y, z}
+	return nil
+}
+
+func (p *planner) dwell(seconds float64) {
+	p.add(OpDwell, "", seconds)
+}
+
+func (p *planner) pause(code string) {
+	p.add(OpPause, code)
+}
+
+func (p *planner) message(msg string) {
+	p.add(OpMessage, msg)
+}
+
+// wait assumes the wait gets what it's waiting for, and that inputs read without waiting are off.
+func (p *planner) wait(n, mode int, timeout float64) (float64, error) {
+	v := assumedWait(mode)
+	p.add(OpWait, "", float64(n), float64(mode), timeout, v)
+	return v, nil
+}
+
+// assumedWait is what a wait in the given mode is assumed to end with, when planning: an input
+// that comes on, or is on, for modes 1 and 3, and off otherwise.
+func assumedWait(mode int) float64 {
+	if mode == 1 || mode == 3 {
+		return 1
+	}
+	return 0
+}
+
+func (p *planner) extrude(mm, feed float64) error {
+	p.add(OpExtrude, "", mm, feed)
+	return nil
+}
+
+func (p *planner) extruded() error {
+	p.add(OpExtruded, "")
+	return nil
+}
+
+func (p *planner) progress(line, lines int) {
+	if p.cmd.line == p.counted {
+		return
+	}
+	p.counted = p.cmd.line
+	if p.ran++; p.limit > 0 && p.ran > p.limit {
+		p.stopped = true
+	}
+}
+
+func (p *planner) selectWCS(i int) error {
+	if err := p.wcs.Select(i); err != nil {
+		return err
+	}
+	p.add(OpWCS, "", float64(i))
+	return nil
+}
+
+func (p *planner) setZero(i int, z [3]float64) error {
+	if err := p.wcs.Set(i, z); err != nil {
+		return err
+	}
+	p.add(OpZero, "", float64(i), z[0], z[1], z[2])
+	return nil
+}
+
+func (p *planner) mount(id int) error {
+	if err := p.tools.Mount(id); err != nil {
+		return err
+	}
+	p.add(OpTool, "", float64(id))
+	return nil
+}
+
+func (p *planner) running() bool {
+	return !p.stopped
+}
+
+func (p *planner) stop() {
+	p.stopped = true
+	p.reason = p.last
+	p.line = p.lineNumber()
+}
+
+// log keeps hold of the last line logged, to say why the program stopped.
+func (p *planner) log(msg string) {
+	p.text += msg
+	if strings.HasSuffix(msg, "\n") {
+		p.last = strings.TrimSpace(p.text)
+		p.text = ""
+	}
+}
+
+// Plan works out what running the program read from r would do, without doing any of it. The
+// program starts from the executor's work offsets and mounted tool, but only running the plan
+// changes them.
+//
+// A plan can't know what the arm will find, so it assumes every M66 gets what it waits for, that
+// inputs read without waiting are off, and that probes touch at their target. Running the plan
+// stops where that turns out to be wrong.
+func (e *Executor) Plan(r io.Reader) (*Plan, error) {
+	p := &planner{plan: &Plan{}, wcs: e.wcs.clone(), tools: e.tools.clone(), limit: e.planLimit}
+	p.cmd = &Cmd{m: p, log: p.log, wcs: p.wcs, tools: p.tools}
+	if err := e.run(p.cmd, r); err != nil {
+		return nil, err
+	}
+	if p.limit > 0 && p.ran > p.limit {
+		return nil, ErrTooLong
+	}
+	if p.stopped {
+		return nil, fmt.Errorf("line %d stops the program: %s", p.line, p.reason)
+	}
+	return p.plan, nil
+}
+
+// RunPlan runs a plan on the executor's arm, returning once it's done or stopped. Unlike Run, it
+// stops at the first step that fails, since the rest of the plan was worked out assuming it
+// wouldn't.
+func (e *Executor) RunPlan(p *Plan) error {
+	return e.RunPlanFrom(p, 0)
+}
+
+// runPlan runs the plan's steps, one by one, replaying those for lines before from.
+func (e *Executor) runPlan(p *Plan, from int) error {
+	l := live{e.arm, e}
+	var m machine = l
+	var rp *replay
+	if from > 1 {
+		rp = newReplay(l, from)
+		m = rp
+	}
+	lines := 0
+	for _, s := range p.Steps {
+		if s.Line > lines {
+			lines = s.Line
+		}
+	}
+	for _, s := range p.Steps {
+		if !e.Running() {
+			return nil
+		}
+		if rp != nil && s.Line >= from {
+			if err := rp.resume(); err != nil {
+				return fmt.Errorf("resuming at line %d: %s", s.Line, err)
+			}
+			m, rp = l, nil
+		}
+		m.progress(s.Line, lines)
+		if rp != nil {
+			if err := s.run(rp); err != nil {
+				return fmt.Errorf("line %d: %s", s.Line, err)
+			}
+			continue
+		}
+		e.log(s.String())
+		if err := s.run(m); err == errStopped {
+			e.log(" → stopped\n")
+			return nil
+		} else if err != nil {
+			e.log(fmt.Sprintf(" → %s\n", err))
+			return fmt.Errorf("line %d: %s", s.Line, err)
+		}
+		e.log(" → OK\n")
+	}
+	if rp != nil && e.Running() {
+		return fmt.Errorf("the plan ends before line %d", from)
+	}
+	return nil
+}
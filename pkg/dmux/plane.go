@@ -0,0 +1,103 @@
+package dmux
+
+import (
+	"fmt"
+	"math"
+)
+
+// add, sub and scale work on the orientation as well as the position, so they can be used to
+// interpolate between two poses. The rest only deal with the position.
+
+func (p point) add(q point) point {
+	return point{x: p.x + q.x, y: p.y + q.y, z: p.z + q.z, a: p.a + q.a, b: p.b + q.b, c: p.c + q.c}
+}
+
+func (p point) sub(q point) point {
+	return point{x: p.x - q.x, y: p.y - q.y, z: p.z - q.z, a: p.a - q.a, b: p.b - q.b, c: p.c - q.c}
+}
+
+func (p point) scale(s float64) point {
+	return point{x: p.x * s, y: p.y * s, z: p.z * s, a: p.a * s, b: p.b * s, c: p.c * s}
+}
+
+func (p point) dot(q point) float64 {
+	return p.x*q.x + p.y*q.y + p.z*q.z
+}
+
+func (p point) cross(q point) point {
+	return point{
+		x: p.y*q.z - p.z*q.y,
+		y: p.z*q.x - p.x*q.z,
+		z: p.x*q.y - p.y*q.x,
+	}
+}
+
+func (p point) norm() float64 {
+	return math.Sqrt(p.dot(p))
+}
+
+// vec and array convert between positions and the plain arrays the exported API uses.
+
+func vec(a [3]float64) point {
+	return point{x: a[0], y: a[1], z: a[2]}
+}
+
+func (p point) array() [3]float64 {
+	return [3]float64{p.x, p.y, p.z}
+}
+
+// Frame is the orientation of the work surface, given by its x, y and z axes in arm coordinates.
+type Frame struct {
+	x, y, z point
+}
+
+// Level is the frame of a table that's perfectly level with the arm.
+var Level = Frame{x: point{x: 1}, y: point{y: 1}, z: point{z: 1}}
+
+// apply rotates p from the frame into arm coordinates.
+func (f Frame) apply(p point) point {
+	return f.x.scale(p.x).add(f.y.scale(p.y)).add(f.z.scale(p.z))
+}
+
+// unapply rotates p from arm coordinates into the frame.
+func (f Frame) unapply(p point) point {
+	return point{x: p.dot(f.x), y: p.dot(f.y), z: p.dot(f.z)}
+}
+
+// Matrix returns the frame's axes, as the rows of a rotation matrix.
+func (f Frame) Matrix() [3][3]float64 {
+	return [3][3]float64{
+		{f.x.x, f.x.y, f.x.z},
+		{f.y.x, f.y.y, f.y.z},
+		{f.z.x, f.z.y, f.z.z},
+	}
+}
+
+func frameOf(m [3][3]float64) Frame {
+	return Frame{
+		x: point{x: m[0][0], y: m[0][1], z: m[0][2]},
+		y: point{x: m[1][0], y: m[1][1], z: m[1][2]},
+		z: point{x: m[2][0], y: m[2][1], z: m[2][2]},
+	}
+}
+
+// Normal returns the frame's z axis, the direction the work surface faces.
+func (f Frame) Normal() [3]float64 {
+	return f.z.array()
+}
+
+// PlaneFrame works out the frame of the surface going through p1, p2 and p3. The x axis points from
+// p1 to p2, and the z axis is normal to the surface, pointing up like the arm's.
+func PlaneFrame(p1, p2, p3 [3]float64) (Frame, error) {
+	x, v := vec(p2).sub(vec(p1)), vec(p3).sub(vec(p1))
+	z := x.cross(v)
+	// Points less than a millimetre out of line make for a rather wobbly plane.
+	if x.norm() < 1 || z.norm() < x.norm() {
+		return Frame{}, fmt.Errorf("touched points are too close together or in a line")
+	}
+	if z.z < 0 {
+		z = z.scale(-1)
+	}
+	x, z = x.scale(1/x.norm()), z.scale(1/z.norm())
+	return Frame{x: x, y: z.cross(x), z: z}, nil
+}
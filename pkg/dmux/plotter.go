@@ -0,0 +1,135 @@
+package dmux
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/LHSRobotics/gdmux/pkg/gcode"
+)
+
+// PlotterConfig describes how to draw with a pen. Programs from drawing tools say when the pen
+// goes up and down in different ways, so we work out what they mean and then raise and lower the
+// pen to fixed heights ourselves.
+type PlotterConfig struct {
+	// Pen says how the program raises and lowers the pen: "z" for the pen being down whenever Z
+	// is at or below ZThreshold, or "mcode" for DownCodes and UpCodes.
+	Pen        string
+	ZThreshold float64
+	DownCodes  []string
+	UpCodes    []string
+
+	// UpZ and DownZ are the heights of the pen when it's up and when it's drawing, in work
+	// coordinates. Whatever Z the program asks for is ignored.
+	UpZ   float64
+	DownZ float64
+	// Servo is the digital output that lowers the pen when it's on. With a servo, the arm stays
+	// at DownZ and leaves the lifting to it.
+	Servo int
+
+	// Dwell is how long to wait after the pen goes down, in seconds, for the ink to start flowing.
+	Dwell float64
+}
+
+// LoadPlotter reads a plotter profile from a JSON file.
+func LoadPlotter(name string) (*PlotterConfig, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &PlotterConfig{Pen: "z", DownCodes: []string{"M3"}, UpCodes: []string{"M5"}}
+	if err := json.NewDecoder(f).Decode(p); err != nil {
+		return nil, fmt.Errorf("error reading plotter profile %s: %s", name, err)
+	}
+	if p.Pen != "z" && p.Pen != "mcode" {
+		return nil, fmt.Errorf("unknown pen mode %q in %s", p.Pen, name)
+	}
+	if p.UpZ <= p.DownZ {
+		return nil, fmt.Errorf("UpZ must be above DownZ in %s", name)
+	}
+	return p, nil
+}
+
+// penCode reports whether code raises or lowers the pen, and which.
+func (p *PlotterConfig) penCode(code gcode.Code) (down, ok bool) {
+	if p.Pen != "mcode" {
+		return false, false
+	}
+	for _, c := range p.DownCodes {
+		if gcode.Code(c) == code {
+			return true, true
+		}
+	}
+	for _, c := range p.UpCodes {
+		if gcode.Code(c) == code {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// penHeight returns the height the pen should be at right now, in work coordinates.
+func (c *Cmd) penHeight() float64 {
+	if c.penDown || c.x.plotter.Servo != 0 {
+		return c.x.plotter.DownZ
+	}
+	return c.x.plotter.UpZ
+}
+
+// pen raises or lowers the pen where the arm is, if it isn't already.
+func (c *Cmd) pen(down bool) error {
+	if c.penDown == down {
+		return nil
+	}
+
+	c.penDown = down
+	if down {
+		c.Log("Pen down")
+	} else {
+		c.Log("Pen up")
+	}
+
+	var err error
+	if c.x.plotter.Servo != 0 {
+		err = c.m.Signal(c.x.plotter.Servo, down)
+	} else {
+		p := c.flange(c.toArm(c.at).pose())
+		if c.sixDOF() {
+			err = c.m.MoveStraight6DOF(p.X, p.Y, p.Z, p.Yaw, p.Pitch, p.Roll)
+		} else {
+			err = c.m.MoveStraight(p.X, p.Y, p.Z)
+		}
+	}
+	if err != nil {
+		c.Log(fmt.Sprintf(" → %s\n", err))
+		return err
+	}
+	c.Log(" → OK\n")
+
+	if down && c.x.plotter.Dwell > 0 {
+		c.m.dwell(c.x.plotter.Dwell)
+	}
+	return nil
+}
+
+// plotStraight puts the pen where the program wants it before drawing a line or an arc.
+func (c *Cmd) plotStraight() error {
+	if c.x.plotter == nil || c.x.plotter.Pen != "z" {
+		return nil
+	}
+	return c.pen(c.env['Z'] <= c.x.plotter.ZThreshold)
+}
+
+// plotRapid lifts the pen before a rapid move, and reports whether it should go back down after.
+func (c *Cmd) plotRapid() (down bool, err error) {
+	if c.x.plotter == nil {
+		return false, nil
+	}
+	down = c.penDown
+	if c.x.plotter.Pen == "z" {
+		down = c.env['Z'] <= c.x.plotter.ZThreshold
+	}
+	return down, c.pen(false)
+}
@@ -0,0 +1,53 @@
+package dmux
+
+import (
+	"time"
+)
+
+// Progress is how far the executor has got with the program it's running, or the last one it ran.
+type Progress struct {
+	Running bool
+	Paused  bool
+	// Line is the line being run, of Lines. Loops and subprograms run lines more than once, so
+	// it can go backwards. Running a plan, it's the line of the program the step came from.
+	Line, Lines int
+	// Started is when the program started.
+	Started time.Time
+
+	// Position is where the arm said it was, in arm coordinates, the last time it was asked,
+	// which it is each time it stops. Located is when that was, or zero if it hasn't been asked.
+	Position [3]float64
+	Located  time.Time
+}
+
+// Progress returns how far the program has got.
+func (e *Executor) Progress() Progress {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return Progress{
+		Running:  e.running,
+		Paused:   e.paused,
+		Line:     e.line,
+		Lines:    e.lines,
+		Started:  e.started,
+		Position: e.pos,
+		Located:  e.located,
+	}
+}
+
+func (e *Executor) setLine(line, lines int) {
+	e.mu.Lock()
+	changed := line != e.line || lines != e.lines
+	e.line, e.lines = line, lines
+	e.mu.Unlock()
+	if changed {
+		e.emit(Event{Type: EventProgress, Line: line, Lines: lines})
+	}
+}
+
+func (e *Executor) setPosition(p [3]float64) {
+	e.mu.Lock()
+	e.pos, e.located = p, time.Now()
+	e.mu.Unlock()
+	e.emit(Event{Type: EventMoved, Position: &p})
+}
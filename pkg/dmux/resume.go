@@ -0,0 +1,301 @@
+package dmux
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// replay is the machine the lines before a resumed program's first line run on. Nothing moves,
+// but it keeps track of where the arm would be and what the outputs would be set to, so the
+// program can pick up from there.
+//
+// The replayed lines see copies of the tool table and of the work offsets as they were when the
+// program was last started from the top, since the saved ones hold whatever it went on to set them
+// to, and a G10 L20 would be applied twice. When the program resumes, the zero points the replayed
+// lines set, the active system and the mounted tool are made the real ones.
+type replay struct {
+	live
+	from int
+	// last is the last move the program made, or nil if it hasn't made one.
+	last    *Step
+	outputs map[int]bool
+	analog  map[int]float64
+	wcs     *WorkOffsets
+	tools   *ToolTable
+	// zeroed has the coordinate systems whose zero points the replayed lines set.
+	zeroed map[int]bool
+}
+
+func newReplay(l live, from int) *replay {
+	l.e.mu.Lock()
+	wcs := l.e.initial
+	l.e.mu.Unlock()
+	if wcs == nil {
+		wcs = l.e.wcs
+	}
+	return &replay{
+		live:    l,
+		from:    from,
+		outputs: make(map[int]bool),
+		analog:  make(map[int]float64),
+		wcs:     wcs.clone(),
+		tools:   l.e.tools.clone(),
+		zeroed:  make(map[int]bool),
+	}
+}
+
+func (r *replay) moved(op Op, args ...float64) error {
+	r.last = &Step{Op: op, Args: args}
+	return nil
+}
+
+func (r *replay) Move(x, y, z float64) error {
+	return r.moved(OpMove, x, y, z)
+}
+
+func (r *replay) MoveStraight(x, y, z float64) error {
+	return r.moved(OpLine, x, y, z)
+}
+
+func (r *replay) Move6DOF(x, y, z, yaw, pitch, roll float64) error {
+	return r.moved(OpMove6, x, y, z, yaw, pitch, roll)
+}
+
+func (r *replay) MoveStraight6DOF(x, y, z, yaw, pitch, roll float64) error {
+	return r.moved(OpLine6, x, y, z, yaw, pitch, roll)
+}
+
+func (r *replay) ArcCenter(x, y, z, i, j, k, direction float64) error {
+	return r.moved(OpArc, x, y, z, i, j, k, direction)
+}
+
+func (r *replay) Break() error {
+	return nil
+}
+
+func (r *replay) Ready() error {
+	return r.moved(OpReady)
+}
+
+// Position is where the last move would have left the arm, or where it really is if there hasn't
+// been one. After a Ready, it's unknown, so it's where the arm really is too.
+func (r *replay) Position() (x, y, z float64) {
+	if r.last == nil || r.last.Op == OpReady {
+		return r.live.Position()
+	}
+	return r.last.Args[0], r.last.Args[1], r.last.Args[2]
+}
+
+func (r *replay) Signal(n int, on bool) error {
+	r.outputs[n] = on
+	return nil
+}
+
+func (r *replay) Analog(channel int, value float64) error {
+	r.analog[channel] = value
+	return nil
+}
+
+// Input, wait and Probe make the same assumptions as planning does, so that a plan replays the
+// way it was planned.
+
+func (r *replay) Input(n int) (bool, error) {
+	return false, nil
+}
+
+func (r *replay) wait(n, mode int, timeout float64) (float64, error) {
+	return assumedWait(mode), nil
+}
+
+func (r *replay) Probe(x, y, z float64, n int) error {
+	return r.moved(OpProbe, x, y, z, float64(n))
+}
+
+func (r *replay) dwell(seconds float64) {}
+
+func (r *replay) pause(code string) {}
+
+func (r *replay) message(msg string) {}
+
+func (r *replay) extrude(mm, feed float64) error {
+	return nil
+}
+
+func (r *replay) extruded() error {
+	return nil
+}
+
+func (r *replay) selectWCS(i int) error {
+	return r.wcs.Select(i)
+}
+
+func (r *replay) setZero(i int, z [3]float64) error {
+	if i < 0 {
+		i = r.wcs.active
+	}
+	r.zeroed[i] = true
+	return r.wcs.Set(i, z)
+}
+
+func (r *replay) mount(id int) error {
+	return r.tools.Mount(id)
+}
+
+// progress isn't reported for the lines that are replayed, since they're not really run.
+func (r *replay) progress(line, lines int) {}
+
+// resume gets the arm to where the replayed lines left the program, and the outputs as they set
+// them, ready to carry on. It lifts the tool straight up to the safe height, goes over to above
+// where the program was, sets the outputs, and comes straight down.
+func (r *replay) resume() error {
+	e, l := r.e, r.live
+	e.log(fmt.Sprintf("Resume at line %d\n", r.from))
+	for i := range r.zeroed {
+		if err := e.wcs.Set(i, r.wcs.Get(i)); err != nil {
+			return err
+		}
+	}
+	if err := e.wcs.Select(r.wcs.active); err != nil {
+		return err
+	}
+	if err := e.tools.Mount(r.tools.mounted); err != nil {
+		return err
+	}
+	if r.last == nil || r.last.Op == OpReady {
+		// There's nowhere to go back to, so the program's next move goes straight there, as it
+		// would have.
+		return r.restore()
+	}
+
+	// Keep the tool turned the way the program last turned it.
+	a := r.last.Args
+	sixDOF := r.last.Op == OpMove6 || r.last.Op == OpLine6
+	line := func(x, y, z float64) error {
+		if sixDOF {
+			return l.MoveStraight6DOF(x, y, z, a[3], a[4], a[5])
+		}
+		return l.MoveStraight(x, y, z)
+	}
+	move := func(x, y, z float64) error {
+		if sixDOF {
+			return l.Move6DOF(x, y, z, a[3], a[4], a[5])
+		}
+		return l.Move(x, y, z)
+	}
+	step := func(msg string, f func() error) error {
+		e.log(msg)
+		if err := f(); err != nil {
+			e.log(fmt.Sprintf(" → %s\n", err))
+			return err
+		}
+		e.log(" → OK\n")
+		return nil
+	}
+
+	if err := l.Break(); err != nil {
+		return err
+	}
+	x, y, z := l.Position()
+	safe := e.parking.SafeZ
+	if safe < a[2] {
+		safe = a[2]
+	}
+	if z < safe {
+		if err := step(fmt.Sprintf("Resume: lift to %8.2f", safe), func() error {
+			return line(x, y, safe)
+		}); err != nil {
+			return err
+		}
+	}
+	if err := step(fmt.Sprintf("Resume: go over %8.2f %8.2f %8.2f", a[0], a[1], safe), func() error {
+		return move(a[0], a[1], safe)
+	}); err != nil {
+		return err
+	}
+	if err := r.restore(); err != nil {
+		return err
+	}
+	if err := step(fmt.Sprintf("Resume: down to %8.2f %8.2f %8.2f", a[0], a[1], a[2]), func() error {
+		return line(a[0], a[1], a[2])
+	}); err != nil {
+		return err
+	}
+	return l.Break()
+}
+
+// restore sets the outputs the replayed lines set, in order of their numbers.
+func (r *replay) restore() error {
+	var outs, chans []int
+	for n := range r.outputs {
+		outs = append(outs, n)
+	}
+	for ch := range r.analog {
+		chans = append(chans, ch)
+	}
+	sort.Ints(outs)
+	sort.Ints(chans)
+
+	for _, n := range outs {
+		r.e.log(fmt.Sprintf("Resume: signal %d %v", n, r.outputs[n]))
+		if err := r.live.Signal(n, r.outputs[n]); err != nil {
+			r.e.log(fmt.Sprintf(" → %s\n", err))
+			return err
+		}
+		r.e.log(" → OK\n")
+	}
+	for _, ch := range chans {
+		r.e.log(fmt.Sprintf("Resume: analog %d %.2f", ch, r.analog[ch]))
+		if err := r.live.Analog(ch, r.analog[ch]); err != nil {
+			r.e.log(fmt.Sprintf(" → %s\n", err))
+			return err
+		}
+		r.e.log(" → OK\n")
+	}
+	return nil
+}
+
+// RunFrom runs the program read from r starting at the given line, as if it had been run up to
+// there, for carrying on with a program that failed or was stopped partway. The lines before it
+// are run without moving the arm, to get the program's modes, position and outputs as they'd be,
+// and then the arm makes its way there safely: straight up to the safe height, over, and straight
+// down, with the outputs set. Line 1 or less runs the whole program, as Run does.
+//
+// The replayed lines start from the work offsets the last program run from the top started with,
+// or the current ones if there hasn't been one, so that it's resumed where it left off.
+func (e *Executor) RunFrom(r io.Reader, line int) error {
+	e.start(line)
+	err := e.runFrom(r, line)
+	e.finish(err)
+	return err
+}
+
+func (e *Executor) runFrom(r io.Reader, line int) error {
+	l := live{e.arm, e}
+	if line <= 1 {
+		return e.run(&Cmd{m: l, log: e.log, wcs: e.wcs, tools: e.tools}, r)
+	}
+
+	// Nothing's logged for the lines that are replayed, since they don't do anything.
+	rp := newReplay(l, line)
+	cmd := &Cmd{m: rp, log: func(string) {}, wcs: rp.wcs, tools: rp.tools}
+	if err := e.run(cmd, r); err != nil {
+		return err
+	}
+	if _, ok := cmd.m.(*replay); ok && e.Running() {
+		return fmt.Errorf("the program ends before line %d", line)
+	}
+	return nil
+}
+
+// RunPlanFrom runs a plan from the steps for the given line of the program on, as RunFrom does a
+// program.
+func (e *Executor) RunPlanFrom(p *Plan, line int) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	e.start(line)
+	err := e.runPlan(p, line)
+	e.finish(err)
+	return err
+}
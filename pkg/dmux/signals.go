@@ -0,0 +1,210 @@
+package dmux
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// SignalConfig says which of the controller's signals the end effector is wired to. Signal 0
+// means there's nothing wired up.
+type SignalConfig struct {
+	// Spindle is the digital output switching the spindle or laser on, for M3, M4 and M5.
+	Spindle int
+	// SpindleCCW is the digital output that's on when the spindle runs anticlockwise (M4).
+	// Without one, M4 stops the program rather than run the spindle the wrong way.
+	SpindleCCW int
+	// SpindleAnalog is the analog channel setting the power from S, for PWM-capable drivers.
+	SpindleAnalog int
+	// SpindleMax is the S value giving full power, and SpindleVolts the voltage for full power.
+	SpindleMax   float64
+	SpindleVolts float64
+
+	// Mist and Flood are the digital outputs for M7 and M8. M9 turns them both off.
+	Mist  int
+	Flood int
+
+	// Outputs are the digital outputs for M62 to M65, P0 being the first one.
+	Outputs []int
+	// Inputs are the digital inputs for M66, P0 being the first one.
+	Inputs []int
+	// Probe is the digital input that comes on when the probe touches something, for G38.2.
+	Probe int
+}
+
+// inputPoll is how often M66 reads the input it's waiting on.
+const inputPoll = 50 * time.Millisecond
+
+// defaultSignals has no signals at all, but the usual 0-10V analog range.
+var defaultSignals = SignalConfig{SpindleMax: 1000, SpindleVolts: 10}
+
+// LoadSignals reads the signal configuration from a JSON file.
+func LoadSignals(name string) (*SignalConfig, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := &SignalConfig{SpindleMax: 1000, SpindleVolts: 10}
+	if err := json.NewDecoder(f).Decode(sc); err != nil {
+		return nil, fmt.Errorf("error reading signal configuration %s: %s", name, err)
+	}
+	if sc.SpindleMax <= 0 {
+		return nil, fmt.Errorf("SpindleMax must be positive in %s", name)
+	}
+	return sc, nil
+}
+
+// output returns the digital output for M62 to M65 with index p.
+func (sc *SignalConfig) output(p float64) (int, error) {
+	i := int(p)
+	if i < 0 || i >= len(sc.Outputs) || sc.Outputs[i] == 0 {
+		return 0, fmt.Errorf("no output P%d configured", i)
+	}
+	return sc.Outputs[i], nil
+}
+
+// input returns the digital input for M66 with index p.
+func (sc *SignalConfig) input(p float64) (int, error) {
+	i := int(p)
+	if i < 0 || i >= len(sc.Inputs) || sc.Inputs[i] == 0 {
+		return 0, fmt.Errorf("no input P%d configured", i)
+	}
+	return sc.Inputs[i], nil
+}
+
+// spindleVolts turns the spindle speed s into the voltage for its analog output.
+func (sc *SignalConfig) spindleVolts(s float64) float64 {
+	return math.Max(0, math.Min(s/sc.SpindleMax, 1)) * sc.SpindleVolts
+}
+
+// signal sets a digital output, logging what happens. Unconfigured outputs (0) are skipped.
+func (c *Cmd) signal(name string, n int, on bool) {
+	if n == 0 {
+		c.Log(fmt.Sprintf("%s → no signal configured\n", name))
+		return
+	}
+	state := "off"
+	if on {
+		state = "on"
+	}
+	c.Log(fmt.Sprintf("%s: signal %d %s", name, n, state))
+	if err := c.m.Signal(n, on); err != nil {
+		c.Log(fmt.Sprintf(" → %s\n", err))
+		return
+	}
+	c.Log(" → OK\n")
+}
+
+// power sets the power of the spindle from S, if it has an analog output.
+func (c *Cmd) power(name string) {
+	if c.x.signals.SpindleAnalog == 0 {
+		return
+	}
+	v := c.x.signals.spindleVolts(c.env['S'])
+	c.Log(fmt.Sprintf("%s: power %.2fV", name, v))
+	if err := c.m.Analog(c.x.signals.SpindleAnalog, v); err != nil {
+		c.Log(fmt.Sprintf(" → %s\n", err))
+		return
+	}
+	c.Log(" → OK\n")
+}
+
+// spindle turns the spindle on, in the given direction, or off.
+func (c *Cmd) spindle(name string, on, ccw bool) {
+	if on && ccw && c.x.signals.SpindleCCW == 0 {
+		c.Log(fmt.Sprintf("%s → no anticlockwise signal configured\n", name))
+		c.m.stop()
+		return
+	}
+	if on {
+		c.power(name)
+	}
+	if c.x.signals.SpindleCCW != 0 {
+		c.signal(name, c.x.signals.SpindleCCW, on && ccw)
+	}
+	c.signal(name, c.x.signals.Spindle, on)
+	c.spindleOn = on
+}
+
+// waitInput waits on the M66 input given by P. L says what to wait for: 0 for nothing, just read
+// it, 1 for it to come on, 2 for it to go off, 3 for it to be on and 4 for it to be off. Q is the
+// timeout in seconds; without one, we wait for as long as it takes, or until we're stopped.
+//
+// The input's final state ends up in c.input, which is -1 if we timed out.
+func (c *Cmd) waitInput() {
+	n, err := c.x.signals.input(c.env['P'])
+	if err != nil {
+		c.Log(fmt.Sprintf("M66 → %s\n", err))
+		return
+	}
+	mode := 0
+	if c.has('L') {
+		mode = int(c.env['L'])
+	}
+	if mode < 0 || mode > 4 {
+		c.Log(fmt.Sprintf("M66 → unknown wait mode L%d\n", mode))
+		return
+	}
+	timeout := -1.0
+	if c.has('Q') {
+		timeout = c.env['Q']
+	}
+
+	c.Log(fmt.Sprintf("Waiting on input %d", n))
+	v, err := c.m.wait(n, mode, timeout)
+	if err != nil {
+		c.Log(fmt.Sprintf(" → %s\n", err))
+		return
+	}
+	c.input = v
+	if v < 0 {
+		c.Log(" → timed out\n")
+		return
+	}
+	c.Log(fmt.Sprintf(" → %v\n", v == 1))
+}
+
+// probe moves in a straight line towards the current position until the probe input comes on,
+// and leaves the position wherever the arm stopped. Not touching anything stops the program,
+// since it's not safe to carry on from wherever the arm ended up.
+func (c *Cmd) probe() {
+	c.Log("Probe " + c.describe())
+	if c.x.signals.Probe == 0 {
+		c.Log(" → no probe input configured\n")
+		c.m.stop()
+		return
+	}
+	if c.tilted() {
+		c.Log(" → probing only works in the default orientation\n")
+		c.m.stop()
+		return
+	}
+
+	c.sync()
+	from := c.flange(c.toArm(c.start).pose())
+	to := c.flange(c.toArm(c.pos()).pose())
+	if err := c.m.Probe(to.X, to.Y, to.Z, c.x.signals.Probe); err != nil {
+		c.Log(fmt.Sprintf(" → %s\n", err))
+		c.m.stop()
+		return
+	}
+
+	// Work out how far along the line the arm got, and put the position there.
+	x, y, z := c.m.Position()
+	d := point{x: to.X - from.X, y: to.Y - from.Y, z: to.Z - from.Z}
+	t := 1.0
+	if l := d.dot(d); l > 0 {
+		t = math.Max(0, math.Min(1, point{x: x - from.X, y: y - from.Y, z: z - from.Z}.dot(d)/l))
+	}
+	end := c.pos()
+	c.env['X'] = c.start.x + (end.x-c.start.x)*t
+	c.env['Y'] = c.start.y + (end.y-c.start.y)*t
+	c.env['Z'] = c.start.z + (end.z-c.start.z)*t
+	c.probed = c.pos()
+	c.at = c.pos()
+	c.Log(fmt.Sprintf(" → touched at %8.2f %8.2f %8.2f\n", c.env['X'], c.env['Y'], c.env['Z']))
+}
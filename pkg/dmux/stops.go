@@ -0,0 +1,96 @@
+package dmux
+
+import (
+	"fmt"
+)
+
+// wake sends on resumec without blocking, in case nothing is waiting on it.
+func (e *Executor) wake() {
+	select {
+	case e.resumec <- true:
+	default:
+	}
+}
+
+// waitResume pauses the program until the operator resumes it, with Resume or, with a console, by
+// pressing enter.
+func (e *Executor) waitResume(code string) {
+	// Forget about any resume from before we paused.
+	select {
+	case <-e.resumec:
+	default:
+	}
+
+	e.mu.Lock()
+	e.paused = true
+	e.mu.Unlock()
+	e.emit(Event{Type: EventState, State: "paused"})
+	defer func() {
+		e.mu.Lock()
+		e.paused = false
+		e.mu.Unlock()
+	}()
+
+	if e.console != nil {
+		e.log(fmt.Sprintf("%s: paused, press enter to carry on", code))
+		if _, err := e.console.ReadString('\n'); err != nil {
+			e.log(fmt.Sprintf(" → %s\n", err))
+			e.Stop()
+			return
+		}
+	} else {
+		e.log(fmt.Sprintf("%s: paused, resume to carry on", code))
+		<-e.resumec
+	}
+	if !e.Running() {
+		e.log(" → stopped\n")
+		return
+	}
+	e.emit(Event{Type: EventState, State: "running"})
+	e.log(" → resumed\n")
+}
+
+// Resume carries on with a paused program. It reports whether the program was paused.
+func (e *Executor) Resume() bool {
+	if !e.Paused() {
+		return false
+	}
+	e.wake()
+	return true
+}
+
+// Paused reports whether the program is paused at a stop.
+func (e *Executor) Paused() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.paused
+}
+
+// showMessage passes an M117 message on to the operator.
+func (e *Executor) showMessage(msg string) {
+	e.mu.Lock()
+	e.message = msg
+	e.mu.Unlock()
+	e.log(fmt.Sprintf("Message: %s\n", msg))
+}
+
+// Message returns the last message the program showed with M117.
+func (e *Executor) Message() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.message
+}
+
+// OptionalStop reports whether M1 pauses the program.
+func (e *Executor) OptionalStop() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.optional
+}
+
+// SetOptionalStop turns optional stops on or off.
+func (e *Executor) SetOptionalStop(on bool) {
+	e.mu.Lock()
+	e.optional = on
+	e.mu.Unlock()
+}
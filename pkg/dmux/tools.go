@@ -0,0 +1,114 @@
+package dmux
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/LHSRobotics/gdmux/pkg/staubli"
+)
+
+// Tool is an entry in the tool table: something that can be mounted on the arm's flange.
+type Tool struct {
+	ID   int
+	Name string
+	// Offset is where the tool's tip is, in millimetres in the flange's frame. The z offset is
+	// the tool's length, and is only applied after a G43.
+	Offset [3]float64
+	// Diameter is how wide the tool cuts or draws, for cutter radius compensation.
+	Diameter float64
+	// Orientation is how the tool is turned relative to the flange, as V+ Euler angles in degrees.
+	Orientation [3]float64
+}
+
+// turned reports whether the tool points anywhere other than where the flange does.
+func (t *Tool) turned() bool {
+	return t.Orientation != [3]float64{}
+}
+
+// ToolTable holds the tools we know about, and which one is on the arm. The mounted tool outlives
+// the program that mounted it, since it stays on the arm until the next tool change.
+type ToolTable struct {
+	sync.Mutex
+	tools   map[int]*Tool
+	mounted int
+}
+
+// NewToolTable returns an empty tool table, with no tool mounted.
+func NewToolTable() *ToolTable {
+	return &ToolTable{tools: make(map[int]*Tool)}
+}
+
+// clone returns a copy of the table, whose mounted tool can change on its own.
+func (t *ToolTable) clone() *ToolTable {
+	t.Lock()
+	defer t.Unlock()
+	return &ToolTable{tools: t.tools, mounted: t.mounted}
+}
+
+// LoadTools reads a JSON list of tools.
+func LoadTools(name string) (*ToolTable, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list []*Tool
+	if err := json.NewDecoder(f).Decode(&list); err != nil {
+		return nil, fmt.Errorf("error reading tool table %s: %s", name, err)
+	}
+
+	t := &ToolTable{tools: make(map[int]*Tool)}
+	for _, tl := range list {
+		if tl.ID <= 0 {
+			return nil, fmt.Errorf("bad tool id %d in %s", tl.ID, name)
+		}
+		if _, ok := t.tools[tl.ID]; ok {
+			return nil, fmt.Errorf("tool %d is in %s twice", tl.ID, name)
+		}
+		t.tools[tl.ID] = tl
+	}
+	return t, nil
+}
+
+// Get returns the tool with the given id.
+func (t *ToolTable) Get(id int) (*Tool, error) {
+	t.Lock()
+	defer t.Unlock()
+	tl, ok := t.tools[id]
+	if !ok {
+		return nil, fmt.Errorf("no tool %d in the tool table", id)
+	}
+	return tl, nil
+}
+
+// Mount records that the tool with the given id is now on the arm. Tool 0 means no tool at all.
+func (t *ToolTable) Mount(id int) error {
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.tools[id]; !ok && id != 0 {
+		return fmt.Errorf("no tool %d in the tool table", id)
+	}
+	t.mounted = id
+	return nil
+}
+
+// Mounted returns the tool that's on the arm, or nil if there isn't one.
+func (t *ToolTable) Mounted() *Tool {
+	t.Lock()
+	defer t.Unlock()
+	return t.tools[t.mounted]
+}
+
+// tcp returns the tool centre point of the mounted tool, as a pose relative to the flange, with
+// the given tool length.
+func (t *ToolTable) tcp(length float64) staubli.Pose {
+	p := staubli.Pose{Z: length}
+	if tl := t.Mounted(); tl != nil {
+		p.X, p.Y = tl.Offset[0], tl.Offset[1]
+		p.Yaw, p.Pitch, p.Roll = tl.Orientation[0], tl.Orientation[1], tl.Orientation[2]
+	}
+	return p
+}
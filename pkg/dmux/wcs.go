@@ -0,0 +1,192 @@
+package dmux
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// WCSNames are the G-codes selecting each of the work coordinate systems.
+var WCSNames = []string{"G54", "G55", "G56", "G57", "G58", "G59"}
+
+// WorkOffsets holds the zero points of the work coordinate systems (G54 to G59), in arm
+// coordinates, and which of them is active, as well as the orientation of the work surface they're
+// on. Every change is saved to path, if it's set, so the zero points survive a restart.
+type WorkOffsets struct {
+	sync.Mutex
+	path    string
+	active  int
+	systems [6]point
+	plane   Frame
+}
+
+// WCSState is how the work offsets are stored on disk and reported over http.
+type WCSState struct {
+	Active  string
+	Systems map[string][3]float64
+	Plane   *[3][3]float64 `json:",omitempty"`
+}
+
+// WCSIndex returns the index of the work coordinate system with the given name, such as "G55".
+func WCSIndex(name string) (int, error) {
+	for i, n := range WCSNames {
+		if n == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown coordinate system: %s", name)
+}
+
+// NewWorkOffsets returns work offsets with every coordinate system's zero point at def, on a level
+// table, which aren't saved anywhere.
+func NewWorkOffsets(def [3]float64) *WorkOffsets {
+	w := &WorkOffsets{plane: Level}
+	for i := range w.systems {
+		w.systems[i] = vec(def)
+	}
+	return w
+}
+
+// LoadWCS reads the work offsets from path. Coordinate systems that aren't in the file start out
+// at def.
+func LoadWCS(path string, def [3]float64) (*WorkOffsets, error) {
+	w := NewWorkOffsets(def)
+	w.path = path
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return w, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var st WCSState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	if st.Active != "" {
+		if w.active, err = WCSIndex(st.Active); err != nil {
+			return nil, err
+		}
+	}
+	for name, z := range st.Systems {
+		i, err := WCSIndex(name)
+		if err != nil {
+			return nil, err
+		}
+		w.systems[i] = vec(z)
+	}
+	if st.Plane != nil {
+		w.plane = frameOf(*st.Plane)
+	}
+	return w, nil
+}
+
+// State returns the offsets in their serialisable form.
+func (w *WorkOffsets) State() WCSState {
+	w.Lock()
+	defer w.Unlock()
+	return w.state()
+}
+
+// state is State for callers already holding the lock.
+func (w *WorkOffsets) state() WCSState {
+	st := WCSState{
+		Active:  WCSNames[w.active],
+		Systems: make(map[string][3]float64),
+	}
+	for i, z := range w.systems {
+		st.Systems[WCSNames[i]] = z.array()
+	}
+	if w.plane != Level {
+		m := w.plane.Matrix()
+		st.Plane = &m
+	}
+	return st
+}
+
+// save writes the offsets to disk. The caller must hold the lock.
+func (w *WorkOffsets) save() error {
+	if w.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(w.state(), "", "\t")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a crash doesn't leave us with half a state file.
+	tmp := w.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.path)
+}
+
+// Zero returns the zero point of the active coordinate system.
+func (w *WorkOffsets) Zero() [3]float64 {
+	w.Lock()
+	defer w.Unlock()
+	return w.systems[w.active].array()
+}
+
+// Plane returns the orientation of the work surface.
+func (w *WorkOffsets) Plane() Frame {
+	w.Lock()
+	defer w.Unlock()
+	return w.plane
+}
+
+// SetPlane changes the orientation of the work surface to f, with the zero of the active
+// coordinate system at z.
+func (w *WorkOffsets) SetPlane(z [3]float64, f Frame) error {
+	w.Lock()
+	defer w.Unlock()
+	w.systems[w.active] = vec(z)
+	w.plane = f
+	return w.save()
+}
+
+// clone returns a copy of the offsets, which isn't saved anywhere.
+func (w *WorkOffsets) clone() *WorkOffsets {
+	w.Lock()
+	defer w.Unlock()
+	return &WorkOffsets{active: w.active, systems: w.systems, plane: w.plane}
+}
+
+// toArm returns the arm coordinates of p, a point in the active coordinate system.
+func (w *WorkOffsets) toArm(p point) point {
+	w.Lock()
+	defer w.Unlock()
+	return w.systems[w.active].add(w.plane.apply(p))
+}
+
+// Select makes the i-th coordinate system the active one.
+func (w *WorkOffsets) Select(i int) error {
+	w.Lock()
+	defer w.Unlock()
+	w.active = i
+	return w.save()
+}
+
+// Set changes the zero point of the i-th coordinate system, or of the active one if i is negative.
+func (w *WorkOffsets) Set(i int, z [3]float64) error {
+	w.Lock()
+	defer w.Unlock()
+	if i < 0 {
+		i = w.active
+	}
+	w.systems[i] = vec(z)
+	return w.save()
+}
+
+// Get returns the zero point of the i-th coordinate system, or of the active one if i is negative.
+func (w *WorkOffsets) Get(i int) [3]float64 {
+	w.Lock()
+	defer w.Unlock()
+	if i < 0 {
+		i = w.active
+	}
+	return w.systems[i].array()
+}
@@ -0,0 +1,65 @@
+// Package extruder drives an external extruder controller, for 3D printing with the arm.
+//
+// The controller is expected to speak enough RepRap G-code to move its E axis: a board running
+// Marlin or similar firmware, with just the extruder motor hooked up, does the job.
+package extruder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type Extruder struct {
+	rw       io.ReadWriter
+	reader   *bufio.Reader
+	relative bool
+}
+
+func NewExtruder(rw io.ReadWriter) *Extruder {
+	return &Extruder{
+		rw:     rw,
+		reader: bufio.NewReader(rw),
+	}
+}
+
+// cmd sends a line of G-code to the controller and waits for it to be acknowledged.
+func (e *Extruder) cmd(format string, args ...interface{}) error {
+	_, err := fmt.Fprintf(e.rw, format+"\n", args...)
+	if err != nil {
+		return fmt.Errorf("error sending command to extruder: %s", err)
+	}
+
+	for {
+		line, err := e.reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("error reading reply from extruder: %s", err)
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "ok"):
+			return nil
+		case strings.HasPrefix(line, "Error") || strings.HasPrefix(line, "!!"):
+			return fmt.Errorf("error from extruder: %s", line)
+		}
+		// Anything else is chatter, like temperature reports or "echo:" lines.
+	}
+}
+
+// Start starts pushing mm millimetres of filament (pulling, if negative) at feed millimetres per
+// minute. It returns as soon as the controller has queued the move.
+func (e *Extruder) Start(mm, feed float64) error {
+	if !e.relative {
+		if err := e.cmd("M83"); err != nil {
+			return err
+		}
+		e.relative = true
+	}
+	return e.cmd("G1 E%.5f F%.1f", mm, feed)
+}
+
+// Wait waits for the controller to finish everything it's been asked to do.
+func (e *Extruder) Wait() error {
+	return e.cmd("M400")
+}
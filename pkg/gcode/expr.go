@@ -0,0 +1,318 @@
+package gcode
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// evaluator reads values and expressions, in LinuxCNC's syntax, from s starting at pos.
+type evaluator struct {
+	p   *Program
+	s   string
+	pos int
+}
+
+// param refers to a numbered parameter like #12, or a named one like #<depth>.
+type param struct {
+	n    int
+	name string
+}
+
+func (e *evaluator) skip() {
+	for e.pos < len(e.s) && (e.s[e.pos] == ' ' || e.s[e.pos] == '\t') {
+		e.pos++
+	}
+}
+
+func (e *evaluator) peek() byte {
+	e.skip()
+	if e.pos >= len(e.s) {
+		return 0
+	}
+	return e.s[e.pos]
+}
+
+// word reads a run of letters, in upper case.
+func (e *evaluator) word() string {
+	e.skip()
+	start := e.pos
+	for e.pos < len(e.s) && isLetter(e.s[e.pos]) {
+		e.pos++
+	}
+	return strings.ToUpper(e.s[start:e.pos])
+}
+
+func isLetter(b byte) bool {
+	return b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z'
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9' || b == '.'
+}
+
+// ref reads the parameter after a #.
+func (e *evaluator) ref() (param, error) {
+	if e.peek() == '<' {
+		end := strings.IndexByte(e.s[e.pos:], '>')
+		if end < 0 {
+			return param{}, fmt.Errorf("unterminated parameter name")
+		}
+		name := strings.ToLower(strings.Replace(e.s[e.pos+1:e.pos+end], " ", "", -1))
+		e.pos += end + 1
+		if name == "" {
+			return param{}, fmt.Errorf("empty parameter name")
+		}
+		return param{name: name}, nil
+	}
+	v, err := e.value()
+	if err != nil {
+		return param{}, err
+	}
+	n := int(math.Floor(v + 0.5))
+	if n < 1 {
+		return param{}, fmt.Errorf("bad parameter number %d", n)
+	}
+	return param{n: n}, nil
+}
+
+// value reads a single value: a number, a parameter, a bracketed expression or a function,
+// possibly with a sign in front.
+func (e *evaluator) value() (float64, error) {
+	switch b := e.peek(); {
+	case b == 0:
+		return 0, fmt.Errorf("missing value")
+	case b == '-' || b == '+':
+		e.pos++
+		v, err := e.value()
+		if b == '-' {
+			v = -v
+		}
+		return v, err
+	case b == '#':
+		e.pos++
+		r, err := e.ref()
+		if err != nil {
+			return 0, err
+		}
+		return e.p.get(r), nil
+	case b == '[':
+		return e.bracket()
+	case isDigit(b):
+		start := e.pos
+		for e.pos < len(e.s) && isDigit(e.s[e.pos]) {
+			e.pos++
+		}
+		return strconv.ParseFloat(e.s[start:e.pos], 64)
+	case isLetter(b):
+		return e.function(e.word())
+	}
+	return 0, fmt.Errorf("unexpected %q", e.s[e.pos])
+}
+
+// bracket reads an expression in square brackets.
+func (e *evaluator) bracket() (float64, error) {
+	if e.peek() != '[' {
+		return 0, fmt.Errorf("expected [")
+	}
+	e.pos++
+	v, err := e.binary(0)
+	if err != nil {
+		return 0, err
+	}
+	if e.peek() != ']' {
+		return 0, fmt.Errorf("expected ]")
+	}
+	e.pos++
+	return v, nil
+}
+
+// precedence gives the binary operators, from the loosest binding to the tightest.
+var precedence = map[string]int{
+	"AND": 1, "OR": 1, "XOR": 1,
+	"EQ": 2, "NE": 2, "GT": 2, "GE": 2, "LT": 2, "LE": 2,
+	"+": 3, "-": 3,
+	"*": 4, "/": 4, "MOD": 4,
+	"**": 5,
+}
+
+// operator reads the binary operator at pos, if there is one, without consuming it.
+func (e *evaluator) operator() (string, int) {
+	e.skip()
+	rest := e.s[e.pos:]
+	switch {
+	case strings.HasPrefix(rest, "**"):
+		return "**", 2
+	case rest == "":
+		return "", 0
+	case strings.IndexByte("*/+-", rest[0]) >= 0:
+		return rest[:1], 1
+	}
+	n := 0
+	for n < len(rest) && isLetter(rest[n]) {
+		n++
+	}
+	op := strings.ToUpper(rest[:n])
+	if _, ok := precedence[op]; !ok {
+		return "", 0
+	}
+	return op, n
+}
+
+// binary reads an expression with operators binding at least as tightly as min.
+func (e *evaluator) binary(min int) (float64, error) {
+	v, err := e.value()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op, n := e.operator()
+		if op == "" || precedence[op] < min {
+			return v, nil
+		}
+		e.pos += n
+		w, err := e.binary(precedence[op] + 1)
+		if err != nil {
+			return 0, err
+		}
+		if v, err = apply(op, v, w); err != nil {
+			return 0, err
+		}
+		if err := finite(v); err != nil {
+			return 0, fmt.Errorf("%s %s", op, err)
+		}
+	}
+}
+
+// finite checks that a result is a number the machine can use, rather than NaN or infinity.
+func finite(v float64) error {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Errorf("gives %v", v)
+	}
+	return nil
+}
+
+func truth(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func apply(op string, v, w float64) (float64, error) {
+	switch op {
+	case "**":
+		return math.Pow(v, w), nil
+	case "*":
+		return v * w, nil
+	case "/":
+		if w == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return v / w, nil
+	case "MOD":
+		if w == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		m := math.Mod(v, w)
+		if m < 0 {
+			m += math.Abs(w)
+		}
+		return m, nil
+	case "+":
+		return v + w, nil
+	case "-":
+		return v - w, nil
+	case "EQ":
+		return truth(v == w), nil
+	case "NE":
+		return truth(v != w), nil
+	case "GT":
+		return truth(v > w), nil
+	case "GE":
+		return truth(v >= w), nil
+	case "LT":
+		return truth(v < w), nil
+	case "LE":
+		return truth(v <= w), nil
+	case "AND":
+		return truth(v != 0 && w != 0), nil
+	case "OR":
+		return truth(v != 0 || w != 0), nil
+	case "XOR":
+		return truth((v != 0) != (w != 0)), nil
+	}
+	return 0, fmt.Errorf("unknown operator %s", op)
+}
+
+// functions are the functions of one value. Angles are in degrees. Values they're not defined
+// for, like SQRT of a negative number, are errors.
+var functions = map[string]func(float64) float64{
+	"ABS":   math.Abs,
+	"ACOS":  func(v float64) float64 { return math.Acos(v) * 180 / math.Pi },
+	"ASIN":  func(v float64) float64 { return math.Asin(v) * 180 / math.Pi },
+	"COS":   func(v float64) float64 { return math.Cos(v * math.Pi / 180) },
+	"EXP":   math.Exp,
+	"FIX":   math.Floor,
+	"FUP":   math.Ceil,
+	"ROUND": func(v float64) float64 { return math.Floor(v + 0.5) },
+	"LN":    math.Log,
+	"SIN":   func(v float64) float64 { return math.Sin(v * math.Pi / 180) },
+	"SQRT":  math.Sqrt,
+	"TAN":   func(v float64) float64 { return math.Tan(v * math.Pi / 180) },
+}
+
+// function reads the argument of the function name, and applies it.
+func (e *evaluator) function(name string) (float64, error) {
+	switch name {
+	case "ATAN":
+		// ATAN[y]/[x], the angle of the point x,y.
+		y, err := e.bracket()
+		if err != nil {
+			return 0, err
+		}
+		if e.peek() != '/' {
+			return 0, fmt.Errorf("ATAN needs [y]/[x]")
+		}
+		e.pos++
+		x, err := e.bracket()
+		if err != nil {
+			return 0, err
+		}
+		return math.Atan2(y, x) * 180 / math.Pi, nil
+	case "EXISTS":
+		// EXISTS[#<name>] says whether a named parameter has been set.
+		if e.peek() != '[' {
+			return 0, fmt.Errorf("EXISTS needs [#<name>]")
+		}
+		e.pos++
+		if e.peek() != '#' {
+			return 0, fmt.Errorf("EXISTS needs [#<name>]")
+		}
+		e.pos++
+		r, err := e.ref()
+		if err != nil {
+			return 0, err
+		}
+		if e.peek() != ']' {
+			return 0, fmt.Errorf("expected ]")
+		}
+		e.pos++
+		return truth(e.p.exists(r)), nil
+	}
+
+	f, ok := functions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown function %s", name)
+	}
+	v, err := e.bracket()
+	if err != nil {
+		return 0, err
+	}
+	r := f(v)
+	if err := finite(r); err != nil {
+		return 0, fmt.Errorf("%s[%v] %s", name, v, err)
+	}
+	return r, nil
+}
@@ -10,6 +10,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"strings"
 	"unicode"
 )
 
@@ -19,8 +20,17 @@ type Line struct {
 	Codes   []Code
 	Comment string
 	Text    string
+	// Message is the text following a code that takes the rest of the line as a message, like
+	// M117.
+	Message string
+	// Number is where the line is in the program, counting from 1, for lines that come from a
+	// Program.
+	Number int
 }
 
+// messageCodes are the codes that take the rest of the line as a message rather than more codes.
+var messageCodes = map[Code]bool{"M117": true, "m117": true}
+
 type Parser struct {
 	scan *bufio.Scanner
 }
@@ -78,13 +88,19 @@ func line(t string) (*Line, error) {
 		case b >= 'A' && b <= 'z': // Regular code
 			end := pos + 1
 			for end < len(t) {
-				if unicode.IsSpace(rune(t[end])) {
+				// A comment can follow a code without a space, as in "M104 S0; heater off".
+				if unicode.IsSpace(rune(t[end])) || t[end] == ';' || t[end] == '(' {
 					break
 				}
 				end++
 			}
-			l.Codes = append(l.Codes, Code(t[pos:end]))
+			code := Code(t[pos:end])
+			l.Codes = append(l.Codes, code)
 			pos = end
+			if messageCodes[code] {
+				l.Message = strings.TrimSpace(t[pos:])
+				return &l, nil
+			}
 		default:
 			return nil, fmt.Errorf("couldn't parse line: %c %v", b, t)
 		}
@@ -1,8 +1,10 @@
 package gcode
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -13,6 +15,7 @@ func TestSamples(t *testing.T) {
 		"samples/gopro.gcode",
 		"samples/glasses.gcode",
 		"samples/gopro.nc",
+		"samples/square_inch.gcode",
 	}
 	for _, f := range correctfiles {
 		r, err := os.Open(f)
@@ -33,3 +36,30 @@ func TestSamples(t *testing.T) {
 		}
 	}
 }
+
+func TestMessage(t *testing.T) {
+	p := NewParser(strings.NewReader("M117 Swap to the red pen; 50% done\n"))
+	l, err := p.Next()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if len(l.Codes) != 1 || l.Codes[0] != "M117" {
+		t.Errorf("got codes %q, want just M117", l.Codes)
+	}
+	if want := "Swap to the red pen; 50% done"; l.Message != want {
+		t.Errorf("got message %q, want %q", l.Message, want)
+	}
+}
+
+func TestTrailingComment(t *testing.T) {
+	p := NewParser(strings.NewReader("M104 S0; heater off\nG1 X1(left)\n"))
+	for _, want := range [][]Code{{"M104", "S0"}, {"G1", "X1"}} {
+		l, err := p.Next()
+		if err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+		if fmt.Sprint(l.Codes) != fmt.Sprint(want) {
+			t.Errorf("got codes %q, want %q", l.Codes, want)
+		}
+	}
+}
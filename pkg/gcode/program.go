@@ -0,0 +1,678 @@
+package gcode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Program runs a whole program, working out its parameters, expressions and control flow, and
+// hands out the lines that are left for the machine, one at a time.
+//
+// It follows LinuxCNC:
+//   - #12 and #<name> are parameters, set with #12 = value. Everything on a line is worked out
+//     before any of its parameters are set. Names starting with _ are global; other names, and
+//     #1 to #30, are local to a subroutine.
+//   - [#1 * 2 + 1] is an expression, with the usual operators and functions like SIN[30].
+//   - o-words do the control flow: o100 sub/endsub/call/return, o101 while/endwhile,
+//     o102 do/while, o103 if/elseif/else/endif, o104 repeat/endrepeat, and break and continue.
+//
+// Subprograms in the Fanuc style work too: M98 P1000 L2 runs the lines after O1000 twice, up to
+// an M99.
+//
+// A # that isn't followed by a number, a < or a [ is still a comment, like CamBam writes.
+//
+// A loop that never hands out a line, like "o1 while [1]" straight followed by "o1 endwhile",
+// would never give the machine a chance to stop it, so Next gives up after maxSteps lines without
+// one.
+type Program struct {
+	lines  []string
+	pc     int
+	params map[int]float64
+	global map[string]float64
+	frames []*frame
+	// labels has the lines with each o-word, in order.
+	labels map[string][]int
+	// subprograms has the line starting each O-numbered subprogram, for M98.
+	subprograms map[int]int
+	// dos has the line of the do that each while ending a do loop goes back to.
+	dos map[int]int
+}
+
+// maxSteps is how many lines of the source Next works through, at most, looking for one to hand
+// out.
+const maxSteps = 1000000
+
+// frame is a subroutine call.
+type frame struct {
+	// ret is the line to go back to.
+	ret int
+	// saved are the caller's #1 to #30, which the subroutine has its own of.
+	saved [30]float64
+	// named are the local named parameters.
+	named map[string]float64
+	// repeats counts down the repeat loops that are running.
+	repeats map[int]int
+
+	// start and count are for M98: the first line of the subprogram, and how many more times
+	// it has to run.
+	start, count int
+	m98          bool
+}
+
+// NewProgram reads the whole program from r.
+func NewProgram(r io.Reader) (*Program, error) {
+	p := &Program{
+		params:      make(map[int]float64),
+		global:      make(map[string]float64),
+		labels:      make(map[string][]int),
+		subprograms: make(map[int]int),
+		dos:         make(map[int]int),
+		frames:      []*frame{{named: make(map[string]float64), repeats: make(map[int]int)}},
+	}
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		p.lines = append(p.lines, scan.Text())
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+
+	// O-numbered lines are only subprograms when something calls them; otherwise they're just
+	// the program's number, as Fanuc programs start with.
+	called := make(map[int]bool)
+	for _, t := range p.lines {
+		if l, err := line(t); err == nil && hasCode(l, "M98") {
+			if n, ok := number(l, 'P'); ok {
+				called[int(n)] = true
+			}
+		}
+	}
+
+	// A while ends a do loop if the innermost block that's open with the same label is a do, and
+	// starts a while loop otherwise.
+	type block struct {
+		label, kw string
+		line      int
+	}
+	var open []block
+	innermost := func(label string) int {
+		for k := len(open) - 1; k >= 0; k-- {
+			if open[k].label == label {
+				return k
+			}
+		}
+		return -1
+	}
+	for i, t := range p.lines {
+		label, kw, _, ok := oword(t)
+		if !ok {
+			continue
+		}
+		p.labels[label] = append(p.labels[label], i)
+		if n, err := strconv.Atoi(label); err == nil && kw == "" && called[n] {
+			p.subprograms[n] = i
+		}
+
+		switch kw {
+		case "sub", "if", "repeat", "do":
+			open = append(open, block{label, kw, i})
+		case "while":
+			if k := innermost(label); k >= 0 && open[k].kw == "do" {
+				p.dos[i] = open[k].line
+				open = open[:k]
+			} else {
+				open = append(open, block{label, kw, i})
+			}
+		case "endsub", "endif", "endrepeat", "endwhile":
+			if k := innermost(label); k >= 0 {
+				open = open[:k]
+			}
+		}
+	}
+	return p, nil
+}
+
+// Len returns the number of lines in the program.
+func (p *Program) Len() int {
+	return len(p.lines)
+}
+
+// Param returns the value of the numbered parameter n.
+func (p *Program) Param(n int) float64 {
+	return p.params[n]
+}
+
+// SetParam sets the numbered parameter n, such as the results of probing that the machine
+// passes back to the program.
+func (p *Program) SetParam(n int, v float64) {
+	p.params[n] = v
+}
+
+func (p *Program) top() *frame {
+	return p.frames[len(p.frames)-1]
+}
+
+func (p *Program) get(r param) float64 {
+	switch {
+	case r.name == "":
+		return p.params[r.n]
+	case r.name[0] == '_':
+		return p.global[r.name]
+	}
+	return p.top().named[r.name]
+}
+
+func (p *Program) set(r param, v float64) {
+	switch {
+	case r.name == "":
+		p.params[r.n] = v
+	case r.name[0] == '_':
+		p.global[r.name] = v
+	default:
+		p.top().named[r.name] = v
+	}
+}
+
+func (p *Program) exists(r param) bool {
+	switch {
+	case r.name == "":
+		_, ok := p.params[r.n]
+		return ok
+	case r.name[0] == '_':
+		_, ok := p.global[r.name]
+		return ok
+	}
+	_, ok := p.top().named[r.name]
+	return ok
+}
+
+// oword splits up a line starting with an o-word, like "o100 while [#1 LT 3]", into its label,
+// its keyword in lower case, and the rest. Named labels look like o<name>.
+func oword(t string) (label, kw, rest string, ok bool) {
+	t = strings.TrimSpace(t)
+	if len(t) > 0 && (t[0] == 'N' || t[0] == 'n') {
+		i := 1
+		for i < len(t) && isDigit(t[i]) {
+			i++
+		}
+		t = strings.TrimSpace(t[i:])
+	}
+	if len(t) < 2 || t[0] != 'O' && t[0] != 'o' {
+		return "", "", "", false
+	}
+
+	t = t[1:]
+	if t[0] == '<' {
+		end := strings.IndexByte(t, '>')
+		if end < 0 {
+			return "", "", "", false
+		}
+		label, t = strings.ToLower(t[1:end]), t[end+1:]
+	} else {
+		i := 0
+		for i < len(t) && t[i] >= '0' && t[i] <= '9' {
+			i++
+		}
+		if i == 0 {
+			return "", "", "", false
+		}
+		n, _ := strconv.Atoi(t[:i])
+		label, t = strconv.Itoa(n), t[i:]
+	}
+
+	t = strings.TrimSpace(t)
+	i := 0
+	for i < len(t) && isLetter(t[i]) {
+		i++
+	}
+	return label, strings.ToLower(t[:i]), strings.TrimSpace(t[i:]), true
+}
+
+// find returns the first line after (or, going back, before) line i with the o-word label and
+// one of the keywords.
+func (p *Program) find(label string, i int, back bool, kws ...string) (int, error) {
+	lines := p.labels[label]
+	for k := range lines {
+		j := lines[k]
+		if back {
+			j = lines[len(lines)-1-k]
+		}
+		if back && j >= i || !back && j <= i {
+			continue
+		}
+		_, kw, _, _ := oword(p.lines[j])
+		for _, want := range kws {
+			if kw == want {
+				return j, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("o%s has no %s", label, strings.Join(kws, " or "))
+}
+
+// Next returns the next line for the machine.
+func (p *Program) Next() (*Line, error) {
+	steps := 0
+	for p.pc < len(p.lines) {
+		i := p.pc
+		p.pc++
+
+		if steps++; steps > maxSteps {
+			return nil, fmt.Errorf("line %d: %d steps without a line to run, which looks like an endless loop", i+1, maxSteps)
+		}
+		if label, kw, rest, ok := oword(p.lines[i]); ok {
+			if err := p.control(i, label, kw, rest); err != nil {
+				return nil, fmt.Errorf("line %d: %s", i+1, err)
+			}
+			continue
+		}
+
+		l, err := p.eval(p.lines[i])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		if done, err := p.subprogram(l); err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		} else if done {
+			continue
+		}
+		l.Number = i + 1
+		return l, nil
+	}
+	return nil, io.EOF
+}
+
+// eval works out the parameters and expressions on a line, leaving the plain codes, and then sets
+// the parameters the line assigns to.
+func (p *Program) eval(t string) (*Line, error) {
+	type assignment struct {
+		r param
+		v float64
+	}
+	var set []assignment
+
+	var out []byte
+	e := &evaluator{p: p, s: t}
+	for e.pos < len(t) {
+		b := t[e.pos]
+		switch {
+		case b == '(':
+			end := strings.IndexByte(t[e.pos:], ')')
+			if end < 0 {
+				end = len(t) - e.pos - 1
+			}
+			out = append(out, t[e.pos:e.pos+end+1]...)
+			e.pos += end + 1
+			continue
+		case b == ';':
+			out = append(out, t[e.pos:]...)
+			e.pos = len(t)
+			continue
+		case b == '#' && e.pos+1 < len(t) && (isDigit(t[e.pos+1]) || strings.IndexByte("<[#", t[e.pos+1]) >= 0):
+			e.pos++
+			r, err := e.ref()
+			if err != nil {
+				return nil, err
+			}
+			end := e.pos
+			if e.peek() != '=' {
+				// Not an assignment, so leave any space after it alone.
+				e.pos = end
+				out = appendValue(out, p.get(r))
+				continue
+			}
+			e.pos++
+			v, err := e.value()
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, assignment{r, v})
+			continue
+		case b == '[':
+			v, err := e.bracket()
+			if err != nil {
+				return nil, err
+			}
+			out = appendValue(out, v)
+			continue
+		case b == '#':
+			// A comment.
+			out = append(out, t[e.pos:]...)
+			e.pos = len(t)
+			continue
+		case isLetter(b):
+			// Copy the whole word, so messages can be left alone.
+			end := e.pos + 1
+			for end < len(t) && (isDigit(t[end]) || t[end] == '-' && end == e.pos+1) {
+				end++
+			}
+			out = append(out, t[e.pos:end]...)
+			if messageCodes[Code(t[e.pos:end])] {
+				out = append(out, t[end:]...)
+				end = len(t)
+			}
+			e.pos = end
+			continue
+		}
+		out = append(out, b)
+		e.pos++
+	}
+
+	l, err := line(string(out))
+	if err != nil {
+		return nil, err
+	}
+	l.Text = t
+	for _, a := range set {
+		p.set(a.r, a.v)
+	}
+	return l, nil
+}
+
+// appendValue writes v into a line, folding it into a sign that's already there.
+func appendValue(out []byte, v float64) []byte {
+	if n := len(out); n > 0 && (out[n-1] == '-' || out[n-1] == '+') {
+		if out[n-1] == '-' {
+			v = -v
+		}
+		out = out[:n-1]
+	}
+	// Six places is plenty for the machine, and hides the rounding in things like SIN[30].
+	f := strings.TrimRight(strconv.FormatFloat(v, 'f', 6, 64), "0")
+	f = strings.TrimSuffix(f, ".")
+	if f == "-0" {
+		f = "0"
+	}
+	return append(out, f...)
+}
+
+// number returns the value of the first code on l starting with letter, if there is one.
+func number(l *Line, letter byte) (float64, bool) {
+	for _, c := range l.Codes {
+		if len(c) > 1 && (c[0] == letter || c[0] == letter+'a'-'A') {
+			if v, err := strconv.ParseFloat(string(c[1:]), 64); err == nil {
+				return v, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// hasCode reports whether l has the code c, in either case.
+func hasCode(l *Line, c Code) bool {
+	for _, lc := range l.Codes {
+		if strings.ToUpper(string(lc)) == string(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// subprogram deals with M98 and M99, reporting whether it has taken care of the line.
+func (p *Program) subprogram(l *Line) (bool, error) {
+	for _, c := range l.Codes {
+		switch strings.ToUpper(string(c)) {
+		case "M98":
+			n, ok := number(l, 'P')
+			if !ok {
+				return true, fmt.Errorf("M98 needs a P")
+			}
+			start, ok := p.subprograms[int(n)]
+			if !ok {
+				return true, fmt.Errorf("no subprogram O%d", int(n))
+			}
+			count := 1.0
+			if v, ok := number(l, 'L'); ok {
+				count = v
+			}
+			if count < 1 {
+				return true, nil
+			}
+			p.frames = append(p.frames, &frame{
+				ret: p.pc, start: start + 1, count: int(count), m98: true,
+				named: p.top().named, repeats: make(map[int]int),
+			})
+			p.pc = start + 1
+			return true, nil
+		case "M99":
+			f := p.top()
+			if len(p.frames) == 1 {
+				// The end of the main program.
+				p.pc = len(p.lines)
+				return true, nil
+			}
+			if !f.m98 {
+				return true, fmt.Errorf("M99 in an o-word subroutine")
+			}
+			if f.count--; f.count > 0 {
+				p.pc = f.start
+			} else {
+				p.frames = p.frames[:len(p.frames)-1]
+				p.pc = f.ret
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// args evaluates the values after an o-word, like the arguments of a call.
+func (p *Program) args(rest string) ([]float64, error) {
+	e := &evaluator{p: p, s: rest}
+	var vs []float64
+	for e.peek() != 0 && e.peek() != '(' && e.peek() != ';' {
+		v, err := e.value()
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// condition evaluates the condition after an o-word.
+func (p *Program) condition(rest string) (bool, error) {
+	vs, err := p.args(rest)
+	if err != nil {
+		return false, err
+	}
+	if len(vs) != 1 {
+		return false, fmt.Errorf("expected a condition")
+	}
+	return vs[0] != 0, nil
+}
+
+// control carries out the o-word on line i.
+func (p *Program) control(i int, label, kw, rest string) error {
+	switch kw {
+	case "":
+		n, _ := strconv.Atoi(label)
+		if _, ok := p.subprograms[n]; !ok {
+			// Just the program's number.
+			return nil
+		}
+		// A subprogram, which only runs with M98.
+		for j := i + 1; j < len(p.lines); j++ {
+			if l, err := line(p.lines[j]); err == nil && hasCode(l, "M99") {
+				p.pc = j + 1
+				return nil
+			}
+		}
+		return fmt.Errorf("O%s has no M99", label)
+
+	case "sub":
+		// Subroutines only run when they're called.
+		j, err := p.find(label, i, false, "endsub")
+		if err != nil {
+			return err
+		}
+		p.pc = j + 1
+
+	case "call":
+		s, err := p.find(label, -1, false, "sub")
+		if err != nil {
+			return err
+		}
+		vs, err := p.args(rest)
+		if err != nil {
+			return err
+		}
+		if len(vs) > 30 {
+			return fmt.Errorf("too many arguments")
+		}
+		f := &frame{ret: p.pc, named: make(map[string]float64), repeats: make(map[int]int)}
+		for n := 1; n <= 30; n++ {
+			f.saved[n-1] = p.params[n]
+			p.params[n] = 0
+		}
+		for n, v := range vs {
+			p.params[n+1] = v
+		}
+		p.frames = append(p.frames, f)
+		p.pc = s + 1
+
+	case "endsub", "return":
+		f := p.top()
+		if len(p.frames) == 1 || f.m98 {
+			return fmt.Errorf("%s outside a subroutine", kw)
+		}
+		if vs, err := p.args(rest); err != nil {
+			return err
+		} else if len(vs) > 0 {
+			p.global["_value"] = vs[0]
+		}
+		for n := 1; n <= 30; n++ {
+			p.params[n] = f.saved[n-1]
+		}
+		p.frames = p.frames[:len(p.frames)-1]
+		p.pc = f.ret
+
+	case "if":
+		ok, err := p.condition(rest)
+		if err != nil || ok {
+			return err
+		}
+		// Find the branch to take instead.
+		j := i
+		for {
+			if j, err = p.find(label, j, false, "elseif", "else", "endif"); err != nil {
+				return err
+			}
+			_, kw, rest, _ := oword(p.lines[j])
+			if kw == "elseif" {
+				if ok, err := p.condition(rest); err != nil {
+					return err
+				} else if !ok {
+					continue
+				}
+			}
+			p.pc = j + 1
+			return nil
+		}
+
+	case "elseif", "else":
+		// The end of the branch that was taken.
+		j, err := p.find(label, i, false, "endif")
+		if err != nil {
+			return err
+		}
+		p.pc = j + 1
+
+	case "endif", "do":
+
+	case "while":
+		ok, err := p.condition(rest)
+		if err != nil {
+			return err
+		}
+		if do, end := p.dos[i]; end {
+			// The end of a do loop.
+			if ok {
+				p.pc = do + 1
+			}
+			return nil
+		}
+		if !ok {
+			j, err := p.find(label, i, false, "endwhile")
+			if err != nil {
+				return err
+			}
+			p.pc = j + 1
+		}
+
+	case "endwhile":
+		j, err := p.find(label, i, true, "while")
+		if err != nil {
+			return err
+		}
+		p.pc = j
+
+	case "repeat":
+		reps := p.top().repeats
+		n, ok := reps[i]
+		if !ok {
+			vs, err := p.args(rest)
+			if err != nil {
+				return err
+			}
+			if len(vs) != 1 {
+				return fmt.Errorf("repeat needs a count")
+			}
+			n = int(math.Floor(vs[0] + 0.5))
+		}
+		if n <= 0 {
+			delete(reps, i)
+			j, err := p.find(label, i, false, "endrepeat")
+			if err != nil {
+				return err
+			}
+			p.pc = j + 1
+			return nil
+		}
+		reps[i] = n - 1
+
+	case "endrepeat":
+		j, err := p.find(label, i, true, "repeat")
+		if err != nil {
+			return err
+		}
+		p.pc = j
+
+	case "break", "continue":
+		if j, err := p.find(label, i, false, "endwhile", "endrepeat"); err == nil {
+			if kw == "break" {
+				if r, err := p.find(label, i, true, "repeat"); err == nil {
+					delete(p.top().repeats, r)
+				}
+				p.pc = j + 1
+			} else {
+				p.pc = j
+			}
+			return nil
+		}
+		// A do loop, which ends with a while.
+		j := -1
+		for _, k := range p.labels[label] {
+			if _, end := p.dos[k]; end && k > i {
+				j = k
+				break
+			}
+		}
+		if j < 0 {
+			return fmt.Errorf("%s outside a loop", kw)
+		}
+		if kw == "break" {
+			p.pc = j + 1
+		} else {
+			p.pc = j
+		}
+
+	default:
+		return fmt.Errorf("unknown o-word keyword %q", kw)
+	}
+	return nil
+}
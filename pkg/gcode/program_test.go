@@ -0,0 +1,220 @@
+package gcode
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// runProgram returns the codes of every line the program hands out, one string per line.
+func runProgram(t *testing.T, prog string) []string {
+	p, err := NewProgram(strings.NewReader(prog))
+	if err != nil {
+		t.Fatalf("couldn't read program: %v", err)
+	}
+	var got []string
+	for {
+		l, err := p.Next()
+		if err == io.EOF {
+			return got
+		} else if err != nil {
+			t.Fatalf("error running program: %v", err)
+		}
+		var codes []string
+		for _, c := range l.Codes {
+			codes = append(codes, string(c))
+		}
+		if len(codes) > 0 {
+			got = append(got, strings.Join(codes, " "))
+		}
+	}
+}
+
+func checkProgram(t *testing.T, prog string, want []string) {
+	got := runProgram(t, prog)
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines, want %d: %q", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParameters(t *testing.T) {
+	checkProgram(t, `#1 = 3
+#<depth> = [#1 * 2]
+G1 X#1 Y-#1 Z-#<depth>
+#1 = [#1 + 1] G1 X#1 (set after the line)
+G1 X#1 Y[2 ** 3 MOD 5] Z[SIN[30] * 4]
+G1 X[ATAN[1]/[1]] Y[#1 GT 3 AND #1 LT 5] Z[EXISTS[#<nothing>]]
+#<_zero> = 0
+G[#<_zero>] X0
+`, []string{
+		"G1 X3 Y-3 Z-6",
+		"G1 X3",
+		"G1 X4 Y3 Z2",
+		"G1 X45 Y1 Z0",
+		"G0 X0",
+	})
+}
+
+func TestExpressionErrors(t *testing.T) {
+	for _, prog := range []string{
+		"G1 X[SQRT[-1]] Y0 Z0",
+		"G1 X[LN[0]]",
+		"G1 X[LN[-2]]",
+		"G1 X[ACOS[2]]",
+		"G1 X[ASIN[-1.5]]",
+		"G1 X[1 / 0]",
+		"G1 X[1 MOD 0]",
+		"G1 X[-8 ** 0.5]",
+		"G1 X[0 ** -1]",
+		"G1 X[EXP[1000]]",
+	} {
+		p, err := NewProgram(strings.NewReader(prog))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l, err := p.Next(); err == nil {
+			t.Errorf("%s: got %q, want an error", prog, l.Codes)
+		}
+	}
+}
+
+func TestControl(t *testing.T) {
+	checkProgram(t, `o<square> sub
+  G1 X#1 Y0
+  G1 X#1 Y#1
+  o1 if [#1 GT 5]
+    G1 X0 Y#1
+  o1 elseif [#1 GT 2]
+    G1 X1
+  o1 else
+    G1 X2
+  o1 endif
+  o<square> return [#1 * 2]
+o<square> endsub
+o<square> call [10]
+o<square> call [3]
+#2 = 0
+o2 while [#2 LT 3]
+  #2 = [#2 + 1]
+  o2 if [#2 EQ 2]
+    o2 continue
+  o2 endif
+  G1 Z#2
+o2 endwhile
+o3 repeat [2]
+  G0 Z#<_value>
+o3 endrepeat
+o4 do
+  G0 X#2
+  o4 break
+o4 while [1]
+`, []string{
+		"G1 X10 Y0",
+		"G1 X10 Y10",
+		"G1 X0 Y10",
+		"G1 X3 Y0",
+		"G1 X3 Y3",
+		"G1 X1",
+		"G1 Z1",
+		"G1 Z3",
+		"G0 Z6",
+		"G0 Z6",
+		"G0 X3",
+	})
+}
+
+func TestLoops(t *testing.T) {
+	// A while loop straight after a do loop with the same label is a loop of its own.
+	checkProgram(t, `#1 = 0
+o5 do
+  #1 = [#1 + 1]
+o5 while [#1 LT 2]
+o5 while [#1 LT 4]
+  G1 X#1
+  #1 = [#1 + 1]
+o5 endwhile
+`, []string{
+		"G1 X2",
+		"G1 X3",
+	})
+
+	// A loop that never hands out a line gives up rather than spinning for ever.
+	p, err := NewProgram(strings.NewReader("o1 while [1]\no1 endwhile\nG0 X0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Next(); err == nil || err == io.EOF {
+		t.Errorf("an endless loop gave %v, want an error", err)
+	}
+}
+
+func TestSubprograms(t *testing.T) {
+	checkProgram(t, `O0001 (the program's number)
+G0 X0
+M98 P1000 L2
+G0 X9
+M30
+O1000
+G1 X1
+M99
+`, []string{
+		"G0 X0",
+		"G1 X1",
+		"G1 X1",
+		"G0 X9",
+		"M30",
+	})
+}
+
+func TestLineNumbers(t *testing.T) {
+	// Lines keep their place in the source, even when a loop runs them again.
+	p, err := NewProgram(strings.NewReader("G0 X0\no1 repeat [2]\n  G1 X1\no1 endrepeat\nG0 X2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for {
+		l, err := p.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, l.Number)
+	}
+	if want := []int{1, 3, 3, 5}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got line numbers %v, want %v", got, want)
+	}
+	if p.Len() != 5 {
+		t.Errorf("got %d lines, want 5", p.Len())
+	}
+}
+
+func TestProgramSamples(t *testing.T) {
+	for _, name := range []string{"samples/london_hackspace_logo.nc", "samples/gopro.nc", "samples/square_inch.gcode"} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatalf("couldn't open test input: %v", err)
+		}
+		p, err := NewProgram(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for {
+			if _, err := p.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("%s: %v", name, err)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,8 @@
+G20 ; set units to inches
+G1 X0 Y0 Z1
+
+G1 X2
+G2 X2 Y4 I0 J2
+G3 X2 Y0 Z0.5 J-2
+
+G0 Y-1 F10
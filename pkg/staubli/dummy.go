@@ -5,11 +5,13 @@ import (
 	"log"
 )
 
-type dummy struct{}
+type dummy struct {
+	cur point
+}
 
 var Dummy = &dummy{}
 
-func dummyMove(x, y, z float64) error {
+func (s *dummy) move(x, y, z float64) error {
 	// We just make up some bounding box to return some errors
 	if x > 200 || x < -200 ||
 		y > 200 || y < -200 ||
@@ -17,25 +19,59 @@ func dummyMove(x, y, z float64) error {
 		return fmt.Errorf("out of range")
 	}
 	log.Printf("dummy move!")
+	s.cur.x, s.cur.y, s.cur.z = x, y, z
 	return nil
 }
 
 func (s *dummy) Move6DOF(x, y, z, yaw, pitch, roll float64) error {
-	return dummyMove(x, y, z)
+	return s.move(x, y, z)
+}
+
+func (s *dummy) MoveStraight6DOF(x, y, z, yaw, pitch, roll float64) error {
+	return s.move(x, y, z)
 }
 
 func (s *dummy) Move(x, y, z float64) error {
-	return dummyMove(x, y, z)
+	return s.move(x, y, z)
 }
 
 func (s *dummy) MoveStraight(x, y, z float64) error {
-	return dummyMove(x, y, z)
+	return s.move(x, y, z)
 }
 
 func (s *dummy) ArcCenter(x, y, z, i, j, k, direction float64) error {
-	return dummyMove(x, y, z)
+	return s.move(x, y, z)
+}
+
+func (s *dummy) Position() (x, y, z float64) {
+	return s.cur.x, s.cur.y, s.cur.z
 }
 
 func (s *dummy) Break() error {
 	return nil
 }
+
+func (s *dummy) Ready() error {
+	log.Printf("dummy ready!")
+	s.cur = point{}
+	return nil
+}
+
+func (s *dummy) Signal(n int, on bool) error {
+	log.Printf("dummy signal %d %v!", n, on)
+	return nil
+}
+
+func (s *dummy) Analog(channel int, value float64) error {
+	log.Printf("dummy analog %d %.3f!", channel, value)
+	return nil
+}
+
+func (s *dummy) Input(n int) (bool, error) {
+	return false, nil
+}
+
+// Probe pretends the probe touches something right at the end of the move.
+func (s *dummy) Probe(x, y, z float64, n int) error {
+	return s.move(x, y, z)
+}
@@ -0,0 +1,154 @@
+package staubli
+
+import "math"
+
+// Pose is a position and orientation of the tool. The orientation is in V+'s Euler angles, in
+// degrees: a rotation of Yaw around z, then Pitch around the new y, then Roll around the new z.
+type Pose struct {
+	X, Y, Z          float64
+	Yaw, Pitch, Roll float64
+}
+
+// Quaternion is a unit quaternion describing a rotation.
+type Quaternion struct {
+	W, X, Y, Z float64
+}
+
+func rad(deg float64) float64 { return deg * math.Pi / 180 }
+func deg(rad float64) float64 { return rad * 180 / math.Pi }
+
+// Mul returns the rotation q followed by r, in r's frame.
+func (q Quaternion) Mul(r Quaternion) Quaternion {
+	return Quaternion{
+		W: q.W*r.W - q.X*r.X - q.Y*r.Y - q.Z*r.Z,
+		X: q.W*r.X + q.X*r.W + q.Y*r.Z - q.Z*r.Y,
+		Y: q.W*r.Y - q.X*r.Z + q.Y*r.W + q.Z*r.X,
+		Z: q.W*r.Z + q.X*r.Y - q.Y*r.X + q.Z*r.W,
+	}
+}
+
+func (q Quaternion) dot(r Quaternion) float64 {
+	return q.W*r.W + q.X*r.X + q.Y*r.Y + q.Z*r.Z
+}
+
+// Quaternion returns the pose's orientation as a quaternion.
+func (p Pose) Quaternion() Quaternion {
+	z := func(a float64) Quaternion {
+		return Quaternion{W: math.Cos(rad(a) / 2), Z: math.Sin(rad(a) / 2)}
+	}
+	y := Quaternion{W: math.Cos(rad(p.Pitch) / 2), Y: math.Sin(rad(p.Pitch) / 2)}
+	return z(p.Yaw).Mul(y).Mul(z(p.Roll))
+}
+
+// Euler returns the yaw, pitch and roll of the rotation, in degrees. Pitch is between 0 and 180.
+// When it's 0 or 180, yaw and roll turn around the same axis, and all the turning is put in yaw.
+func (q Quaternion) Euler() (yaw, pitch, roll float64) {
+	// The bits of the rotation matrix we need.
+	r11 := 1 - 2*(q.Y*q.Y+q.Z*q.Z)
+	r21 := 2 * (q.X*q.Y + q.W*q.Z)
+	r13 := 2 * (q.X*q.Z + q.W*q.Y)
+	r23 := 2 * (q.Y*q.Z - q.W*q.X)
+	r31 := 2 * (q.X*q.Z - q.W*q.Y)
+	r32 := 2 * (q.Y*q.Z + q.W*q.X)
+	r33 := 1 - 2*(q.X*q.X+q.Y*q.Y)
+
+	pitch = math.Atan2(math.Hypot(r13, r23), r33)
+	switch {
+	case math.Sin(pitch) > 1e-9:
+		yaw = math.Atan2(r23, r13)
+		roll = math.Atan2(r32, -r31)
+	case r33 > 0:
+		yaw = math.Atan2(r21, r11)
+	default:
+		yaw = math.Atan2(-r21, -r11)
+	}
+	return deg(yaw), deg(pitch), deg(roll)
+}
+
+// Angle returns the angle, in degrees, of the smallest rotation taking q to r.
+func (q Quaternion) Angle(r Quaternion) float64 {
+	d := math.Min(math.Abs(q.dot(r)), 1)
+	return deg(2 * math.Acos(d))
+}
+
+// Slerp interpolates between the rotations q and r, turning at a constant rate around a single
+// axis. t goes from 0, giving q, to 1, giving r.
+func Slerp(q, r Quaternion, t float64) Quaternion {
+	d := q.dot(r)
+	// q and -q are the same rotation; pick the one that's closer so we take the short way round.
+	if d < 0 {
+		r, d = Quaternion{-r.W, -r.X, -r.Y, -r.Z}, -d
+	}
+
+	var a, b float64
+	if d > 0.9995 {
+		// Nearly the same rotation, so plain linear interpolation is fine and avoids dividing by
+		// a tiny sine.
+		a, b = 1-t, t
+	} else {
+		theta := math.Acos(d)
+		a = math.Sin((1-t)*theta) / math.Sin(theta)
+		b = math.Sin(t*theta) / math.Sin(theta)
+	}
+
+	s := Quaternion{
+		W: a*q.W + b*r.W,
+		X: a*q.X + b*r.X,
+		Y: a*q.Y + b*r.Y,
+		Z: a*q.Z + b*r.Z,
+	}
+	n := math.Sqrt(s.dot(s))
+	return Quaternion{s.W / n, s.X / n, s.Y / n, s.Z / n}
+}
+
+// Interpolate returns the pose a fraction t of the way from p to q, moving in a straight line and
+// turning smoothly between the two orientations.
+func Interpolate(p, q Pose, t float64) Pose {
+	switch t {
+	case 0:
+		return p
+	case 1:
+		return q
+	}
+
+	yaw, pitch, roll := Slerp(p.Quaternion(), q.Quaternion(), t).Euler()
+	return Pose{
+		X:     p.X + (q.X-p.X)*t,
+		Y:     p.Y + (q.Y-p.Y)*t,
+		Z:     p.Z + (q.Z-p.Z)*t,
+		Yaw:   yaw,
+		Pitch: pitch,
+		Roll:  roll,
+	}
+}
+
+// Conj returns the inverse of the rotation q.
+func (q Quaternion) Conj() Quaternion {
+	return Quaternion{W: q.W, X: -q.X, Y: -q.Y, Z: -q.Z}
+}
+
+// Rotate returns the vector (x,y,z) rotated by q.
+func (q Quaternion) Rotate(x, y, z float64) (float64, float64, float64) {
+	v := q.Mul(Quaternion{X: x, Y: y, Z: z}).Mul(q.Conj())
+	return v.X, v.Y, v.Z
+}
+
+// Flange returns the pose the arm's flange has to be in for a tool to be in pose p. The tool's tip
+// is at (tool.X, tool.Y, tool.Z) in the flange's frame, and it's turned by tool's Euler angles.
+func (p Pose) Flange(tool Pose) Pose {
+	if tool == (Pose{}) {
+		return p
+	}
+
+	r := p.Quaternion().Mul(tool.Quaternion().Conj())
+	dx, dy, dz := r.Rotate(tool.X, tool.Y, tool.Z)
+	yaw, pitch, roll := r.Euler()
+	return Pose{
+		X:     p.X - dx,
+		Y:     p.Y - dy,
+		Z:     p.Z - dz,
+		Yaw:   yaw,
+		Pitch: pitch,
+		Roll:  roll,
+	}
+}
@@ -0,0 +1,54 @@
+package staubli
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEuler(t *testing.T) {
+	poses := []Pose{
+		{Yaw: DefaultYaw, Pitch: DefaultPitch, Roll: DefaultRoll},
+		{Yaw: 30, Pitch: 45, Roll: -60},
+		{Yaw: -170, Pitch: 120, Roll: 10},
+		{Yaw: 20, Pitch: 0, Roll: 0},
+		{Yaw: 20, Pitch: 180, Roll: 0},
+	}
+	for _, p := range poses {
+		q := p.Quaternion()
+		yaw, pitch, roll := q.Euler()
+		r := Pose{Yaw: yaw, Pitch: pitch, Roll: roll}.Quaternion()
+		if a := q.Angle(r); a > 1e-4 {
+			t.Errorf("%v came back as %.3f %.3f %.3f, %g° off", p, yaw, pitch, roll, a)
+		}
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	p := Pose{X: 0, Yaw: 0, Pitch: 90, Roll: 180}
+	q := Pose{X: 100, Yaw: 90, Pitch: 90, Roll: 180}
+
+	m := Interpolate(p, q, 0.5)
+	if math.Abs(m.X-50) > 1e-9 {
+		t.Errorf("halfway x is %v, want 50", m.X)
+	}
+	mq := m.Quaternion()
+	a, b := p.Quaternion().Angle(mq), mq.Angle(q.Quaternion())
+	if math.Abs(a-45) > 1e-6 || math.Abs(b-45) > 1e-6 {
+		t.Errorf("halfway pose is %.3f° and %.3f° from the ends, want 45° each", a, b)
+	}
+	if Interpolate(p, q, 1) != q {
+		t.Errorf("interpolating all the way doesn't end up at q")
+	}
+}
+
+func TestFlange(t *testing.T) {
+	// A 100mm pen, sticking straight out of a flange that's facing down.
+	down := Pose{X: 500, Y: 0, Z: 0, Yaw: 0, Pitch: 180, Roll: 0}
+	f := down.Flange(Pose{Z: 100})
+	if math.Abs(f.X-500) > 1e-9 || math.Abs(f.Y) > 1e-9 || math.Abs(f.Z-100) > 1e-9 {
+		t.Errorf("flange is at %.3f %.3f %.3f, want 500 0 100", f.X, f.Y, f.Z)
+	}
+	if a := f.Quaternion().Angle(down.Quaternion()); a > 1e-4 {
+		t.Errorf("flange is turned %g° from the tool", a)
+	}
+}
@@ -0,0 +1,143 @@
+package staubli
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Call is a call made to a Recorder: the method, in lower case, and its arguments.
+type Call struct {
+	Name string
+	Args []float64
+}
+
+// String formats the call as the method's name followed by its arguments, rounded to hundredths
+// to hide the noise from parsing G-code as float32.
+func (c Call) String() string {
+	s := c.Name
+	for _, a := range c.Args {
+		// Adding 0 turns -0 into 0.
+		s += fmt.Sprintf(" %.2f", math.Floor(a*100+0.5)/100+0)
+	}
+	return s
+}
+
+// Recorder is an Arm that doesn't move anything, but records every call made to it, for tests.
+// Its answers to Input and Probe come from a script, and any method can be made to fail.
+type Recorder struct {
+	sync.Mutex
+	Calls []Call
+
+	// Inputs are the states Input returns, in turn. Once they run out, inputs are on.
+	Inputs []bool
+	// Touches are where probes touch, in turn. Once they run out, probes touch at their target.
+	Touches [][3]float64
+	// Errors are the errors methods return, by the name they're recorded under. The call is
+	// still recorded.
+	Errors map[string]error
+
+	cur [3]float64
+}
+
+func (r *Recorder) record(name string, args ...float64) error {
+	r.Calls = append(r.Calls, Call{Name: name, Args: args})
+	return r.Errors[name]
+}
+
+// Log returns the calls, one to a line.
+func (r *Recorder) Log() string {
+	r.Lock()
+	defer r.Unlock()
+	var b bytes.Buffer
+	for _, c := range r.Calls {
+		b.WriteString(c.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func (r *Recorder) moveTo(name string, x, y, z float64, args ...float64) error {
+	r.Lock()
+	defer r.Unlock()
+	r.cur = [3]float64{x, y, z}
+	return r.record(name, append([]float64{x, y, z}, args...)...)
+}
+
+func (r *Recorder) Move(x, y, z float64) error {
+	return r.moveTo("move", x, y, z)
+}
+
+func (r *Recorder) MoveStraight(x, y, z float64) error {
+	return r.moveTo("line", x, y, z)
+}
+
+func (r *Recorder) ArcCenter(x, y, z, i, j, k, direction float64) error {
+	return r.moveTo("arc", x, y, z, i, j, k, direction)
+}
+
+func (r *Recorder) Move6DOF(x, y, z, yaw, pitch, roll float64) error {
+	return r.moveTo("move6", x, y, z, yaw, pitch, roll)
+}
+
+func (r *Recorder) MoveStraight6DOF(x, y, z, yaw, pitch, roll float64) error {
+	return r.moveTo("line6", x, y, z, yaw, pitch, roll)
+}
+
+func (r *Recorder) Break() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.record("break")
+}
+
+func (r *Recorder) Ready() error {
+	r.Lock()
+	defer r.Unlock()
+	r.cur = [3]float64{}
+	return r.record("ready")
+}
+
+// Position returns where the last move or probe left the arm. It isn't recorded, since it doesn't
+// do anything.
+func (r *Recorder) Position() (x, y, z float64) {
+	r.Lock()
+	defer r.Unlock()
+	return r.cur[0], r.cur[1], r.cur[2]
+}
+
+func (r *Recorder) Signal(n int, on bool) error {
+	r.Lock()
+	defer r.Unlock()
+	v := 0.0
+	if on {
+		v = 1
+	}
+	return r.record("signal", float64(n), v)
+}
+
+func (r *Recorder) Analog(channel int, value float64) error {
+	r.Lock()
+	defer r.Unlock()
+	return r.record("analog", float64(channel), value)
+}
+
+func (r *Recorder) Input(n int) (bool, error) {
+	r.Lock()
+	defer r.Unlock()
+	on := true
+	if len(r.Inputs) > 0 {
+		on, r.Inputs = r.Inputs[0], r.Inputs[1:]
+	}
+	return on, r.record("input", float64(n))
+}
+
+func (r *Recorder) Probe(x, y, z float64, n int) error {
+	r.Lock()
+	defer r.Unlock()
+	r.cur = [3]float64{x, y, z}
+	if len(r.Touches) > 0 {
+		r.cur, r.Touches = r.Touches[0], r.Touches[1:]
+	}
+	return r.record("probe", x, y, z, float64(n))
+}
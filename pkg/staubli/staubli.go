@@ -17,8 +17,23 @@ type Arm interface {
 	ArcCenter(x, y, z, i, j, k, direction float64) error
 	Break() error
 	Move6DOF(x, y, z, yaw, pitch, roll float64) error
+	MoveStraight6DOF(x, y, z, yaw, pitch, roll float64) error
+	Position() (x, y, z float64)
+	Signal(n int, on bool) error
+	Analog(channel int, value float64) error
+	Input(n int) (bool, error)
+	Probe(x, y, z float64, n int) error
+	Ready() error
 }
 
+// The orientation gcode.pg gives the flange for the moves that don't give one. Euler angles in
+// degrees, as V+ uses them.
+const (
+	DefaultYaw   = 0
+	DefaultPitch = 90
+	DefaultRoll  = 180
+)
+
 type point struct {
 	x, y, z, yaw, pitch, roll float64
 }
@@ -59,6 +74,20 @@ func (s *Staubli) Move6DOF(x, y, z, yaw, pitch, roll float64) error {
 	return nil
 }
 
+// Move the arm with translation and rotation, in a straight line. The controller interpolates the
+// orientation along the way.
+func (s *Staubli) MoveStraight6DOF(x, y, z, yaw, pitch, roll float64) error {
+	_, err := fmt.Fprintf(s.rw, "10 %.3f %.3f %.3f %.3f %.3f %.3f\r\n", x, y, z, yaw, pitch, roll)
+	if err != nil {
+		return fmt.Errorf("error sending coordinates to arm: %s", err)
+	}
+
+	if r := s.readReply(); !strings.HasPrefix(r, "OK") {
+		return fmt.Errorf("error from arm: %s", r)
+	}
+	return nil
+}
+
 // Move the arm to the point (x,y,z) in a straight line.
 func (s *Staubli) MoveStraight(x, y, z float64) error {
 	_, err := fmt.Fprintf(s.rw, "1 %.3f %.3f %.3f\r\n", x, y, z)
@@ -81,13 +110,18 @@ func (s *Staubli) Break() error {
 		return fmt.Errorf("error sending command to arm: %s", err)
 	}
 
+	return s.readPosition()
+}
+
+// readPosition reads an "OK x y z" reply and updates the local state to those coordinates.
+func (s *Staubli) readPosition() error {
 	r := s.readReply()
 	if !strings.HasPrefix(r, "OK") {
 		return fmt.Errorf("error from arm: %s", r)
 	}
 
 	var x, y, z float64
-	_, err = fmt.Sscan(r[2:], &x, &y, &z)
+	_, err := fmt.Sscan(r[2:], &x, &y, &z)
 	if err != nil {
 		return fmt.Errorf("error parsing reply from arm: %s", err)
 	}
@@ -97,6 +131,52 @@ func (s *Staubli) Break() error {
 	return nil
 }
 
+// Probe moves the arm towards (x,y,z) in a straight line, stopping as soon as the digital input n
+// comes on. It returns an error if the arm gets all the way there without the input coming on.
+//
+// Like Break, this updates the local state to the arm's coordinates once it's stopped.
+func (s *Staubli) Probe(x, y, z float64, n int) error {
+	_, err := fmt.Fprintf(s.rw, "7 %.3f %.3f %.3f %d\r\n", x, y, z, n)
+	if err != nil {
+		return fmt.Errorf("error sending coordinates to arm: %s", err)
+	}
+	return s.readPosition()
+}
+
+// Ready moves the arm to its READY position, with the arm pointing straight up, which is where it
+// can be parked safely. Like Break, this updates the local state to the arm's coordinates there.
+func (s *Staubli) Ready() error {
+	_, err := fmt.Fprintf(s.rw, "8\r\n")
+	if err != nil {
+		return fmt.Errorf("error sending command to arm: %s", err)
+	}
+	return s.readPosition()
+}
+
+// Input reads the controller's digital input n.
+func (s *Staubli) Input(n int) (bool, error) {
+	_, err := fmt.Fprintf(s.rw, "6 %d\r\n", n)
+	if err != nil {
+		return false, fmt.Errorf("error sending command to arm: %s", err)
+	}
+
+	r := s.readReply()
+	if !strings.HasPrefix(r, "OK") {
+		return false, fmt.Errorf("error from arm: %s", r)
+	}
+
+	var state int
+	if _, err := fmt.Sscan(r[2:], &state); err != nil {
+		return false, fmt.Errorf("error parsing reply from arm: %s", err)
+	}
+	return state != 0, nil
+}
+
+// Position returns the arm's coordinates, as reported by the last call to Break.
+func (s *Staubli) Position() (x, y, z float64) {
+	return s.cur.x, s.cur.y, s.cur.z
+}
+
 // Move the arm to the point (x,y,z) in a straight line, using its current position as origin.
 func (s *Staubli) MoveRel(x, y, z float64) error {
 	_, err := fmt.Fprintf(s.rw, "3 %.3f %.3f %.3f\r\n", x, y, z)
@@ -110,6 +190,37 @@ func (s *Staubli) MoveRel(x, y, z float64) error {
 	return nil
 }
 
+// Signal turns the controller's digital output n on or off.
+func (s *Staubli) Signal(n int, on bool) error {
+	state := 0
+	if on {
+		state = 1
+	}
+	_, err := fmt.Fprintf(s.rw, "4 %d %d\r\n", n, state)
+	if err != nil {
+		return fmt.Errorf("error sending command to arm: %s", err)
+	}
+
+	if r := s.readReply(); !strings.HasPrefix(r, "OK") {
+		return fmt.Errorf("error from arm: %s", r)
+	}
+	return nil
+}
+
+// Analog sets the controller's analog output channel to value, in volts. This is how we drive
+// outputs with variable power, such as a PWM laser driver.
+func (s *Staubli) Analog(channel int, value float64) error {
+	_, err := fmt.Fprintf(s.rw, "5 %d %.3f\r\n", channel, value)
+	if err != nil {
+		return fmt.Errorf("error sending command to arm: %s", err)
+	}
+
+	if r := s.readReply(); !strings.HasPrefix(r, "OK") {
+		return fmt.Errorf("error from arm: %s", r)
+	}
+	return nil
+}
+
 const (
 	Clockwise     = -1
 	Anticlockwise = 1